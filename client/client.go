@@ -0,0 +1,477 @@
+// Package client is a Go client for the simple-http-server API.
+//
+//	c := client.New("http://localhost:8081", client.WithAccessKey(key))
+//	err := c.AddMessage(ctx, "Hello!", "greeting")
+//	it := c.Messages(ctx, client.ListOptions{Tag: "greeting"})
+//	for it.Next() {
+//		fmt.Println(it.Message().Message)
+//	}
+//	if err := it.Err(); err != nil { ... }
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a message as returned by the server.
+type Message struct {
+	ID          string         `json:"id"`
+	Message     string         `json:"message"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Tags        []string       `json:"tags,omitempty"`
+	Reactions   map[string]int `json:"reactions,omitempty"`
+	Attachments []Attachment   `json:"attachments,omitempty"`
+}
+
+// Attachment describes a file attached to a message.
+type Attachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// Error is returned for responses with a status of 400 and above.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server answered %d: %s", e.StatusCode, e.Message)
+}
+
+// Client talks to one channel of a server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	channel    string
+	accessKey  string
+	clientID   string
+	sign       bool
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAccessKey authenticates requests that change data with the access key
+// of the channel, sent as the access_key parameter.
+func WithAccessKey(key string) Option {
+	return func(c *Client) { c.accessKey = key }
+}
+
+// WithSigning signs requests with the access key instead of sending it, for
+// servers started with -hmac_auth.
+func WithSigning() Option {
+	return func(c *Client) { c.sign = true }
+}
+
+// WithClientID names the client in the X-Client-Id header, which decides
+// whether it is in the rollout of a feature. Without it every Client picks a
+// random id, so its requests get the same features.
+func WithClientID(id string) Option {
+	return func(c *Client) { c.clientID = id }
+}
+
+// WithChannel makes the client talk to a channel other than the default one.
+func WithChannel(name string) Option {
+	return func(c *Client) { c.channel = name }
+}
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how often a request is retried after a transient failure
+// and the backoff before the first retry, which doubles with every further
+// one. The default is 3 retries starting at 200ms.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.maxRetries, c.backoff = n, backoff }
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		backoff:    200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.clientID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		c.clientID = hex.EncodeToString(id)
+	}
+	return c
+}
+
+func (c *Client) prefix() string {
+	if c.channel == "" || c.channel == "default" {
+		return ""
+	}
+	return "/channels/" + url.PathEscape(c.channel)
+}
+
+// AddMessage posts a new message with optional tags.
+func (c *Client) AddMessage(ctx context.Context, message string, tags ...string) error {
+	body, err := json.Marshal(struct {
+		Message string   `json:"message"`
+		Tags    []string `json:"tags,omitempty"`
+	}{message, tags})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/add", nil, body, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetMessage returns one message.
+func (c *Client) GetMessage(ctx context.Context, id string) (*Message, error) {
+	resp, err := c.do(ctx, "GET", "/messages/"+url.PathEscape(id), nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var msg Message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// DeleteMessage removes a message with its attachments.
+func (c *Client) DeleteMessage(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, "DELETE", "/messages/"+url.PathEscape(id), nil, nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// React adds the reaction of user to a message.
+func (c *Client) React(ctx context.Context, id, reaction, user string) error {
+	body, err := json.Marshal(map[string]string{"reaction": reaction, "user": user})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/messages/"+url.PathEscape(id)+"/reactions", nil, body, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListOptions select the messages of a listing.
+type ListOptions struct {
+	// Tag only lists messages with this tag.
+	Tag string
+	// AfterID starts the listing after the message with this id.
+	AfterID string
+	// Limit is the page size, the server default when zero.
+	Limit int
+	// Wait holds the request open until a matching message arrives or it
+	// passes, the listing is empty then.
+	Wait time.Duration
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.Tag != "" {
+		q.Set("tag", o.Tag)
+	}
+	if o.AfterID != "" {
+		q.Set("after_id", o.AfterID)
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Wait > 0 {
+		q.Set("wait", o.Wait.String())
+	}
+	return q
+}
+
+// Page is one page of a listing.
+type Page struct {
+	Messages []Message
+	// Next is the URL of the next page, empty on the last one.
+	Next string
+}
+
+// ListMessages returns one page of messages.
+func (c *Client) ListMessages(ctx context.Context, opts ListOptions) (*Page, error) {
+	return c.page(ctx, c.baseURL+c.prefix()+"/messages?"+opts.query().Encode())
+}
+
+func (c *Client) page(ctx context.Context, pageURL string) (*Page, error) {
+	resp, err := c.doURL(ctx, "GET", pageURL, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var page Page
+	if resp.StatusCode == http.StatusNoContent {
+		return &page, nil
+	}
+	// Listings are a bare list, or an envelope with the next page when the
+	// server rolled the envelope out to this client.
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var envelope struct {
+			Messages []Message `json:"messages"`
+			Next     string    `json:"next"`
+		}
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			return nil, err
+		}
+		page.Messages = envelope.Messages
+		if envelope.Next != "" {
+			page.Next = resolveURL(envelope.Next, pageURL)
+			return &page, nil
+		}
+	} else if err := json.Unmarshal(body, &page.Messages); err != nil {
+		return nil, err
+	}
+	page.Next = nextLink(resp.Header.Get("Link"), pageURL)
+	return &page, nil
+}
+
+// resolveURL returns target resolved against base.
+func resolveURL(target, base string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	t, err := b.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return t.String()
+}
+
+// nextLink returns the absolute rel="next" target of a Link header.
+func nextLink(header, base string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) != `rel="next"` {
+				continue
+			}
+			return resolveURL(target, base)
+		}
+	}
+	return ""
+}
+
+// Iterator walks a listing page by page.
+type Iterator struct {
+	ctx  context.Context
+	c    *Client
+	page []Message
+	next string
+	msg  Message
+	err  error
+}
+
+// Messages returns an iterator over all messages matching opts, fetching
+// pages as they are needed.
+func (c *Client) Messages(ctx context.Context, opts ListOptions) *Iterator {
+	return &Iterator{ctx: ctx, c: c, next: c.baseURL + c.prefix() + "/messages?" + opts.query().Encode()}
+}
+
+// Next advances to the next message and reports whether there is one.
+func (it *Iterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.next == "" {
+			return false
+		}
+		page, err := it.c.page(it.ctx, it.next)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page, it.next = page.Messages, page.Next
+	}
+	it.msg, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Message returns the current message.
+func (it *Iterator) Message() Message {
+	return it.msg
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Subscribe delivers messages newer than afterID as they arrive until ctx
+// is done. It long polls the server, holding each request open for up to
+// wait, which must be above zero. Errors the server may recover from are
+// retried, only the one that ended the subscription, if any, is sent on the
+// error channel before both channels are closed.
+func (c *Client) Subscribe(ctx context.Context, afterID string, wait time.Duration) (<-chan Message, <-chan error) {
+	out := make(chan Message)
+	errc := make(chan error, 1)
+	if wait <= 0 {
+		// Polls without a wait come back at once and would be repeated
+		// as fast as the server answers.
+		errc <- errors.New("client: Subscribe needs a wait above zero")
+		close(out)
+		close(errc)
+		return out, errc
+	}
+	go func() {
+		defer close(out)
+		defer close(errc)
+		for ctx.Err() == nil {
+			it := c.Messages(ctx, ListOptions{AfterID: afterID, Wait: wait})
+			for it.Next() {
+				select {
+				case out <- it.Message():
+					afterID = it.Message().ID
+				case <-ctx.Done():
+					return
+				}
+			}
+			err := it.Err()
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			if apiErr, ok := err.(*Error); ok && apiErr.StatusCode < 500 {
+				errc <- err
+				return
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.backoff):
+			}
+		}
+	}()
+	return out, errc
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, auth bool) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if auth && !c.sign && c.accessKey != "" {
+		query.Set("access_key", c.accessKey)
+	}
+	u := c.baseURL + c.prefix() + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return c.doURL(ctx, method, u, body, auth)
+}
+
+// doURL sends a request, retrying it while the server or the network fail
+// transiently. Writes other than PUT and DELETE are only retried when the
+// server answered 503 or 429 without processing them.
+func (c *Client) doURL(ctx context.Context, method, u string, body []byte, auth bool) (*http.Response, error) {
+	idempotent := method != "POST"
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("X-Client-Id", c.clientID)
+		if auth && c.sign {
+			if err := c.signRequest(req, body); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := c.httpClient.Do(req)
+		wait := backoff
+		retry := false
+		switch {
+		case err != nil:
+			retry = idempotent && ctx.Err() == nil
+		case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests:
+			retry = true
+			if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				wait = time.Duration(s) * time.Second
+			}
+		case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout:
+			retry = idempotent
+		}
+		if !retry || attempt >= c.maxRetries {
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode >= 400 {
+				defer resp.Body.Close()
+				msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+				return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// signRequest adds the X-Signature, X-Timestamp and X-Nonce headers of a
+// signed request.
+func (c *Client) signRequest(req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sum := sha256.Sum256(body)
+	target := req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	mac := hmac.New(sha256.New, []byte(c.accessKey))
+	io.WriteString(mac, req.Method+"\n"+target+"\n"+ts+"\n"+hex.EncodeToString(nonce)+"\n"+hex.EncodeToString(sum[:]))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-Nonce", hex.EncodeToString(nonce))
+	return nil
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/itzmanish/simple-http-server/server"
+
+func main() {
+	server.Main()
+}
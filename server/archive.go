@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// archiver periodically moves messages older than -archive_after from the
+// messages table to messages_archive, keeping the hot table small. Tags,
+// reactions and attachments are keyed by message id and stay where they are.
+func archiver(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(archive_interval)
+	defer ticker.Stop()
+	for {
+		total, err := archiveOlderMessages(ctx)
+		if total > 0 {
+			logger.Println("Archived", total, "messages")
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.Println("Could not archive messages:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// archiveOlderMessages archives in batches until no message is old enough.
+// Every batch is its own transaction so the table is never locked for long.
+func archiveOlderMessages(ctx context.Context) (int, error) {
+	db, err := initDB()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for ctx.Err() == nil {
+		var n int
+		err := withRetry(ctx, "archive_batch", func() (err error) {
+			n, err = archiveBatch(ctx, db)
+			return err
+		})
+		total += n
+		if err != nil || n < archive_batch {
+			return total, err
+		}
+	}
+	return total, ctx.Err()
+}
+
+// archivedMessage is a line of an archive export. Bodies are exported as
+// they are stored, encrypted ones with the id of their key, so an export is
+// no easier to read than the database; restore-archive loads them back.
+type archivedMessage struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel,omitempty"`
+	Message   string    `json:"message"`
+	KeyID     string    `json:"key_id,omitempty"`
+	Timestamp time.Time `json:"created_at"`
+}
+
+func archiveBatch(ctx context.Context, db *sql.DB) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	seconds := int64(math.Ceil(archive_after.Seconds()))
+	// Messages held for review are left alone until a moderator decides.
+	// Ids grow with time, so walking the primary key finds the old messages
+	// first and the scan stops after one batch.
+	rows, err := tx.Query("SELECT id, channel, message, key_id, timestamp FROM messages WHERE flagged = 0 AND timestamp < NOW() - INTERVAL ? SECOND ORDER BY id LIMIT ? FOR UPDATE", seconds, archive_batch)
+	if err != nil {
+		return 0, err
+	}
+	var batch []archivedMessage
+	var ids []interface{}
+	for rows.Next() {
+		var temp archivedMessage
+		var id int64
+		var keyID sql.NullString
+		if err := rows.Scan(&id, &temp.Channel, &temp.Message, &keyID, &temp.Timestamp); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		temp.ID = strconv.FormatInt(id, 10)
+		temp.KeyID = keyID.String
+		batch = append(batch, temp)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	if archive_export {
+		if err := exportBatch(ctx, batch); err != nil {
+			return 0, err
+		}
+	}
+	in := "(" + placeholders(len(ids)) + ")"
+	if _, err := tx.Exec("INSERT INTO messages_archive(id, channel, message, key_id, timestamp) SELECT id, channel, message, key_id, timestamp FROM messages WHERE id IN "+in, ids...); err != nil {
+		return 0, err
+	}
+	// Archived messages are gone from /messages, outbox consumers see them
+	// deleted.
+	for _, id := range ids {
+		if err := recordEvent(tx, eventDeleted, id.(int64)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM messages WHERE id IN "+in, ids...); err != nil {
+		return 0, err
+	}
+	return len(batch), commit(tx)
+}
+
+// exportBatch writes a batch as gzipped NDJSON to the blob store, one object
+// per batch named after its creation day and id range.
+func exportBatch(ctx context.Context, batch []archivedMessage) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, msg := range batch {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("archive/%s/messages-%s-%s.ndjson.gz", time.Now().UTC().Format("2006/01/02"), batch[0].ID, batch[len(batch)-1].ID)
+	return blobs.Put(ctx, key, &buf, int64(buf.Len()), "application/gzip")
+}
+
+// loadArchive loads the messages of an archive export back into
+// messages_archive, leaving out those already there, and returns how many it
+// inserted. Bodies stay as they were exported, encrypted ones are decrypted
+// with the key they name when they are read.
+func loadArchive(ctx context.Context, r io.Reader) (int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("Export is not gzipped: %v", err)
+	}
+	db, err := initDB()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	dec := json.NewDecoder(zr)
+	inserted := 0
+	for line := 1; ; line++ {
+		var msg archivedMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("Export line %d is not valid: %v", line, err)
+		}
+		id, err := parseID(msg.ID)
+		if err != nil {
+			return 0, fmt.Errorf("Export line %d has invalid id %q", line, msg.ID)
+		}
+		if msg.Channel == "" {
+			msg.Channel = defaultChannel
+		}
+		keyID := sql.NullString{String: msg.KeyID, Valid: msg.KeyID != ""}
+		if keyID.Valid && keys().keys[msg.KeyID] == nil {
+			return 0, fmt.Errorf("Message %s is encrypted with unknown key %s", msg.ID, msg.KeyID)
+		}
+		res, err := tx.ExecContext(ctx, "INSERT IGNORE INTO messages_archive(id, channel, message, key_id, timestamp) VALUES (?, ?, ?, ?, ?)", id, msg.Channel, msg.Message, keyID, msg.Timestamp)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		inserted += int(n)
+	}
+	return inserted, commit(tx)
+}
+
+// restoreArchive loads an archive export of -archive_export from the blob
+// store into messages_archive.
+func restoreArchive(fs *flag.FlagSet, args []string) error {
+	key := fs.String("key", "", "Key of the export in the blob store, like archive/2006/01/02/messages-1-500.ndjson.gz")
+	fs.Parse(args)
+	if *key == "" {
+		return errors.New("-key is required")
+	}
+	if err := configure(); err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx := context.Background()
+	r, err := blobs.Get(ctx, *key)
+	if err != nil {
+		return fmt.Errorf("Could not read export %s: %v", *key, err)
+	}
+	defer r.Close()
+	n, err := loadArchive(ctx, r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d archived messages from %s\n", n, *key)
+	return nil
+}
+
+// listArchive serves /messages/archive, paged like /messages.
+func listArchive() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p, err := parsePage(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		zone, err := displayZone(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		if err := pinSnapshot(r, db, "messages_archive", &p); err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get messages from db")
+			return
+		}
+		where := " WHERE a.channel = ? AND a.id > ?"
+		args := []interface{}{channelOf(r).name, p.AfterID}
+		if p.UntilID != 0 {
+			where += " AND a.id <= ?"
+			args = append(args, p.UntilID)
+		}
+		query := "SELECT a.id, a.message, a.timestamp, GROUP_CONCAT(t.name ORDER BY t.name), a.key_id FROM messages_archive a LEFT JOIN message_tags mt ON mt.message_id = a.id LEFT JOIN tags t ON t.id = mt.tag_id" + where + " GROUP BY a.id, a.message, a.timestamp, a.key_id ORDER BY a.id"
+		if p.Limit > 0 {
+			query += " LIMIT ?"
+			args = append(args, p.Limit)
+		}
+		var tags, keyID sql.NullString
+		out, err := scanMessages(r.Context(), db, "list_archive", query, args, p.Limit, func(rows *sql.Rows, msg *messageType) error {
+			err := rows.Scan(&msg.Id, &msg.Message, &msg.Timestamp, &tags, &keyID)
+			if err == nil {
+				msg.Message, err = openBody(msg.Message, keyID)
+			}
+			msg.Tags = splitTags(tags)
+			return err
+		})
+		if out == nil {
+			out = []messageType{}
+		}
+		if err == nil {
+			err = loadDetails(r.Context(), db, out, channelOf(r).prefix(), nil)
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to get messages from db", http.StatusInternalServerError)
+			return
+		}
+
+		inZone(out, zone)
+		if p.Limit == 0 {
+			deprecateAll(rw, r)
+		} else if len(out) == p.Limit {
+			rw.Header().Set("Link", nextPageLink(r, out[len(out)-1].Id, p))
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
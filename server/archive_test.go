@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestArchiveExportStaysEncrypted(t *testing.T) {
+	db := setupStore(t, "-archive_after", "1h", "-archive_export", "-blob_dir", t.TempDir(), "-encryption_keys", "k1=MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	ctx := context.Background()
+	body, keyID, err := sealBody("a secret body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO messages(message, key_id, channel, timestamp) VALUES (?, ?, 'default', NOW() - INTERVAL 1 DAY)", body, keyID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := archiveBatch(ctx, db); err != nil || n != 1 {
+		t.Fatalf("archiveBatch = %d, %v, want 1", n, err)
+	}
+
+	exports, err := blobs.List(ctx, "archive/")
+	if err != nil || len(exports) != 1 {
+		t.Fatalf("exports = %v, %v, want one", exports, err)
+	}
+	r, err := blobs.Get(ctx, exports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	export, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(export), "secret") || !strings.Contains(string(export), `"key_id":"k1"`) {
+		t.Errorf("export = %s, want the body encrypted with k1", export)
+	}
+
+	if _, err := db.Exec("DELETE FROM messages_archive"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{1, 0} {
+		if n, err := loadArchive(ctx, bytes.NewReader(raw)); err != nil || n != want {
+			t.Fatalf("loadArchive = %d, %v, want %d", n, err, want)
+		}
+	}
+	var stored string
+	var storedKey sql.NullString
+	if err := db.QueryRow("SELECT message, key_id FROM messages_archive").Scan(&stored, &storedKey); err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := openBody(stored, storedKey); err != nil || plain != "a secret body" {
+		t.Errorf("restored body = %q, %v", plain, err)
+	}
+}
+
+func TestArchiveBatchEvents(t *testing.T) {
+	db := setupStore(t, "-archive_after", "1h", "-events_url", "nats://127.0.0.1:4222")
+	for _, age := range []string{"1 DAY", "2 DAY", "1 SECOND"} {
+		if _, err := db.Exec("INSERT INTO messages(message, channel, timestamp) VALUES ('hi', 'ops', NOW() - INTERVAL " + age + ")"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := archiveBatch(context.Background(), db); err != nil || n != 2 {
+		t.Fatalf("archiveBatch = %d, %v, want 2", n, err)
+	}
+	var events int
+	if err := db.QueryRow("SELECT COUNT(*) FROM message_events e JOIN messages_archive a ON a.id = e.message_id WHERE e.kind = ? AND e.channel = 'ops'", eventDeleted).Scan(&events); err != nil {
+		t.Fatal(err)
+	}
+	if events != 2 {
+		t.Errorf("deleted events = %d, want 2", events)
+	}
+}
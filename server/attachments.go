@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type attachmentType struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// upload is a validated attachment of a multipart message waiting to be
+// written to the blob store.
+type upload struct {
+	file        *multipart.FileHeader
+	name        string
+	contentType string
+	key         string
+}
+
+var blobs BlobStore
+
+// parseMultipartMessage reads a multipart/form-data post to /add. The message
+// and tags are form fields, every "attachment" part is a file. File parts
+// above the in-memory limit are spooled to temporary files, which are removed
+// by the caller through r.MultipartForm.RemoveAll.
+func parseMultipartMessage(rw http.ResponseWriter, r *http.Request) (messageType, []upload, int, error) {
+	var msg messageType
+	r.Body = http.MaxBytesReader(rw, r.Body, int64(attachment_max_count)*attachment_max_bytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return msg, nil, http.StatusRequestEntityTooLarge, fmt.Errorf("Attachments are too large!")
+		}
+		return msg, nil, http.StatusBadRequest, fmt.Errorf("Unable to read body!")
+	}
+	msg.Message = r.PostFormValue("message")
+	msg.Tags = formTags(r.MultipartForm.Value["tags"])
+
+	files := r.MultipartForm.File["attachment"]
+	if len(files) > attachment_max_count {
+		return msg, nil, http.StatusBadRequest, fmt.Errorf("A message can have at most %d attachments!", attachment_max_count)
+	}
+	uploads := make([]upload, 0, len(files))
+	names := make(map[string]bool, len(files))
+	for _, fh := range files {
+		name := attachmentName(fh.Filename)
+		if name == "" {
+			return msg, nil, http.StatusBadRequest, fmt.Errorf("Attachment name %q is not valid!", fh.Filename)
+		}
+		if names[name] {
+			return msg, nil, http.StatusBadRequest, fmt.Errorf("Attachment %q is sent twice!", name)
+		}
+		names[name] = true
+		if fh.Size > attachment_max_bytes {
+			return msg, nil, http.StatusRequestEntityTooLarge, fmt.Errorf("Attachment %q is larger than %d bytes!", name, attachment_max_bytes)
+		}
+		contentType, err := sniffContentType(fh)
+		if err != nil {
+			return msg, nil, http.StatusBadRequest, fmt.Errorf("Unable to read attachment %q!", name)
+		}
+		if !allowedAttachmentType(contentType) {
+			return msg, nil, http.StatusUnsupportedMediaType, fmt.Errorf("Attachment %q has type %s which is not allowed!", name, contentType)
+		}
+		uploads = append(uploads, upload{file: fh, name: name, contentType: contentType})
+	}
+	return msg, uploads, 0, nil
+}
+
+// parseFormMessage reads an application/x-www-form-urlencoded post to /add,
+// like an HTML form sends, with the message and tags as fields. Bodies that
+// are JSON objects are read as JSON: curl -d sends this type by default.
+func parseFormMessage(rw http.ResponseWriter, r *http.Request) (messageType, error) {
+	var msg messageType
+	body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, 1<<20))
+	if err != nil {
+		return msg, err
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		return decodeMessage(jsonCodec, bytes.NewReader(trimmed))
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return msg, err
+	}
+	msg.Message = values.Get("message")
+	msg.Tags = formTags(values["tags"])
+	return msg, nil
+}
+
+// formTags splits tags form fields, each holding one or a comma separated
+// list of tags.
+func formTags(fields []string) []string {
+	var out []string
+	for _, tags := range fields {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				out = append(out, tag)
+			}
+		}
+	}
+	return out
+}
+
+// attachmentName reduces a client supplied file name to its base name and
+// rejects names that cannot be used as a single URL path segment.
+func attachmentName(filename string) string {
+	name := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == "/" || name == ".." || len(name) > 255 {
+		return ""
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return ""
+		}
+	}
+	return name
+}
+
+// sniffContentType detects the type of an attachment from its content, the
+// Content-Type sent by the client is not trusted.
+func sniffContentType(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+func allowedAttachmentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range strings.Split(attachment_types, ",") {
+		if strings.TrimSpace(allowed) == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// putUploads writes uploads to the blob store under fresh keys. On error the
+// blobs that were already written are removed again.
+func putUploads(ctx context.Context, uploads []upload) error {
+	for i := range uploads {
+		u := &uploads[i]
+		key, err := newBlobKey()
+		if err == nil {
+			err = putUpload(ctx, key, u)
+		}
+		if err != nil {
+			deleteBlobs(ctx, uploadKeys(uploads[:i]))
+			return err
+		}
+		u.key = key
+	}
+	return nil
+}
+
+func putUpload(ctx context.Context, key string, u *upload) error {
+	f, err := u.file.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return blobs.Put(ctx, key, f, u.file.Size, u.contentType)
+}
+
+func uploadKeys(uploads []upload) []string {
+	keys := make([]string, len(uploads))
+	for i, u := range uploads {
+		keys[i] = u.key
+	}
+	return keys
+}
+
+func newBlobKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "attachments/" + hex.EncodeToString(b), nil
+}
+
+// deleteBlobs removes blobs whose rows are gone. Failures only leave orphaned
+// blobs behind, so they are logged rather than returned.
+func deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			log.Println("Unable to delete blob", key, err)
+		}
+	}
+}
+
+func insertAttachments(tx *sql.Tx, messageID int64, uploads []upload) error {
+	for _, u := range uploads {
+		_, err := tx.Exec("INSERT INTO attachments(message_id, name, content_type, size, blob_key) VALUES(?, ?, ?, ?, ?)", messageID, u.name, u.contentType, u.file.Size, u.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAttachments fills in the attachment metadata of a page of messages,
+// with download URLs below prefix.
+func loadAttachments(ctx context.Context, db queryer, msgs []messageType, prefix string) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	byID := make(map[string]*messageType, len(msgs))
+	ids := make([]interface{}, len(msgs))
+	for i := range msgs {
+		byID[msgs[i].Id] = &msgs[i]
+		ids[i] = msgs[i].Id
+	}
+	for start := 0; start < len(ids); start += 500 {
+		end := start + 500
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+		qctx, cancel := queryDeadline(ctx)
+		rows, err := db.QueryContext(qctx, "SELECT message_id, name, content_type, size FROM attachments WHERE message_id IN ("+placeholders(len(chunk))+") ORDER BY message_id, name", chunk...)
+		if err != nil {
+			cancel()
+			return err
+		}
+		for rows.Next() {
+			var id string
+			var a attachmentType
+			if err := rows.Scan(&id, &a.Name, &a.ContentType, &a.Size); err != nil {
+				rows.Close()
+				cancel()
+				return err
+			}
+			if msg := byID[id]; msg != nil {
+				a.URL = prefix + "/messages/" + id + "/attachments/" + url.PathEscape(a.Name)
+				msg.Attachments = append(msg.Attachments, a)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadAttachment streams /messages/{id}/attachments/{name} from the blob
+// store.
+func downloadAttachment(messageID int64, name string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, "Only GET method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		var contentType, key string
+		var size int64
+		// Attachments of archived messages can still be downloaded.
+		channel := channelOf(r).name
+		err = withRetry(r.Context(), "get_attachment", func() error {
+			return db.QueryRow("SELECT content_type, size, blob_key FROM attachments WHERE message_id = ? AND name = ? AND message_id IN (SELECT id FROM messages WHERE channel = ? UNION SELECT id FROM messages_archive WHERE channel = ?)", messageID, name, channel, channel).Scan(&contentType, &size, &key)
+		})
+		if err == sql.ErrNoRows {
+			http.Error(rw, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to get attachment from db", http.StatusInternalServerError)
+			return
+		}
+		body, err := blobs.Get(r.Context(), key)
+		if err != nil {
+			log.Println("Unable to get blob", key, err)
+			http.Error(rw, "Unable to get attachment", http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+		rw.Header().Set("Content-Type", contentType)
+		rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		rw.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.Method == "HEAD" {
+			return
+		}
+		if _, err := io.Copy(rw, body); err != nil {
+			log.Println("Unable to stream blob", key, err)
+		}
+	})
+}
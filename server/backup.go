@@ -0,0 +1,465 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Backups are logical dumps of the database into the blob store, S3 or
+// MinIO with -blob_store=s3, as gzipped NDJSON: a header line, then for
+// every table a line naming its columns followed by one JSON array per row,
+// and a last line with the number of rows so a cut off backup is noticed.
+// They are read in one REPEATABLE READ transaction, a snapshot like
+// /messages/export. Bodies are kept as they are stored, encrypted ones need
+// the same keys to be read after a restore.
+
+const backupFormat = 1
+
+// backupTables are the tables a backup has, in the order they are restored.
+// The outbox of -events_url is left out, restoring it would publish its
+// events again.
+var backupTables = []string{"messages", "tags", "message_tags", "reactions", "attachments", "messages_archive", "usage_counts"}
+
+const backupSuffix = ".ndjson.gz"
+
+// backupLine is any line of a backup but the rows.
+type backupLine struct {
+	Backup        int        `json:"backup,omitempty"`
+	SchemaVersion int        `json:"schema_version,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+	Table         string     `json:"table,omitempty"`
+	Columns       []string   `json:"columns,omitempty"`
+	End           bool       `json:"end,omitempty"`
+	Rows          int        `json:"rows,omitempty"`
+}
+
+// backupRun is how the last backup of this process went, for /admin/stats.
+type backupRun struct {
+	Started     *time.Time `json:"started,omitempty"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	Bytes       int64      `json:"bytes,omitempty"`
+	Rows        int        `json:"rows,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+var lastBackup = struct {
+	sync.Mutex
+	backupRun
+}{}
+
+func backupKey(t time.Time) string {
+	return backup_prefix + "messages-" + t.UTC().Format("20060102T150405Z") + backupSuffix
+}
+
+// backupTime is when the backup at key was made, false for other keys.
+func backupTime(key string) (time.Time, bool) {
+	name := strings.TrimPrefix(key, backup_prefix+"messages-")
+	if len(name) == len(key) || !strings.HasSuffix(name, backupSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102T150405Z", strings.TrimSuffix(name, backupSuffix))
+	return t, err == nil
+}
+
+// listBackups returns the keys of the backups in the blob store, oldest
+// first.
+func listBackups(ctx context.Context) ([]string, error) {
+	keys, err := blobs.List(ctx, backup_prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := keys[:0]
+	for _, key := range keys {
+		if _, ok := backupTime(key); ok {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// backupDatabase writes a backup to the blob store and applies the
+// retention, returning its key and how many rows it has.
+func backupDatabase(ctx context.Context) (string, int, error) {
+	started := time.Now().UTC()
+	lastBackup.Lock()
+	lastBackup.Started, lastBackup.Finished = &started, nil
+	lastBackup.Unlock()
+
+	key := backupKey(started)
+	size, rows, err := writeBackup(ctx, key, started)
+
+	finished := time.Now().UTC()
+	lastBackup.Lock()
+	lastBackup.Finished, lastBackup.Key, lastBackup.Bytes, lastBackup.Rows, lastBackup.Error = &finished, key, size, rows, ""
+	if err != nil {
+		lastBackup.Error = err.Error()
+	} else {
+		lastBackup.LastSuccess = &finished
+	}
+	lastBackup.Unlock()
+	if err != nil {
+		return key, rows, err
+	}
+	if _, err := pruneBackups(ctx, finished); err != nil {
+		log.Println("Could not apply the backup retention:", err)
+	}
+	return key, rows, nil
+}
+
+// writeBackup dumps the tables into a temporary file, so uploads have a
+// length without holding the backup in memory, and puts it at key.
+func writeBackup(ctx context.Context, key string, at time.Time) (int64, int, error) {
+	db, err := initDB()
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := os.CreateTemp("", "backup-*"+backupSuffix)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	zw := gzip.NewWriter(f)
+	buffered := bufio.NewWriter(zw)
+	enc := json.NewEncoder(buffered)
+	if err := enc.Encode(backupLine{Backup: backupFormat, SchemaVersion: len(migrations), CreatedAt: &at}); err != nil {
+		return 0, 0, err
+	}
+	total := 0
+	for _, table := range backupTables {
+		n, err := dumpTable(ctx, tx, table, enc)
+		total += n
+		if err != nil {
+			return 0, total, fmt.Errorf("backing up %s: %v", table, err)
+		}
+	}
+	if err := enc.Encode(backupLine{End: true, Rows: total}); err != nil {
+		return 0, total, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, total, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, total, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, total, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, total, err
+	}
+	return size, total, blobs.Put(ctx, key, f, size, "application/gzip")
+}
+
+func dumpTable(ctx context.Context, tx *sql.Tx, table string, enc *json.Encoder) (int, error) {
+	var rows *sql.Rows
+	err := timed(ctx, "backup", func() (err error) {
+		rows, err = tx.QueryContext(ctx, "SELECT * FROM "+table)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if err := enc.Encode(backupLine{Table: table, Columns: columns}); err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	row := make([]interface{}, len(columns))
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i, v := range values {
+			row[i] = backupValue(v)
+		}
+		if err := enc.Encode(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// backupValue is how a column value is written: numbers as they are,
+// times and text as strings MySQL takes back for the column, and bytes that
+// are not text as {"base64": "..."}.
+func backupValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		if !utf8.Valid(v) {
+			return map[string]string{"base64": base64.StdEncoding.EncodeToString(v)}
+		}
+		return string(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999")
+	}
+	return v
+}
+
+// pruneBackups deletes the backups beyond -backup_keep and older than
+// -backup_max_age, always keeping the newest, and returns how many.
+func pruneBackups(ctx context.Context, now time.Time) (int, error) {
+	keys, err := listBackups(ctx)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	for i, key := range keys[:len(keys)-1] {
+		at, _ := backupTime(key)
+		tooMany := backup_keep > 0 && i < len(keys)-backup_keep
+		tooOld := backup_max_age > 0 && now.Sub(at) > backup_max_age
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := blobs.Delete(ctx, key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d backups by the retention\n", deleted)
+	}
+	return deleted, nil
+}
+
+var backupColumn = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// restoreBatch is how many rows are inserted by a statement.
+const restoreBatch = 200
+
+// restoreBackup loads a backup into the database in one transaction and
+// returns how many rows it had. The tables must be empty unless replace
+// deletes their rows first.
+func restoreBackup(ctx context.Context, r io.Reader, replace bool) (int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("Backup is not gzipped: %v", err)
+	}
+	lines := bufio.NewScanner(zr)
+	lines.Buffer(make([]byte, 64*1024), 64<<20)
+	var header backupLine
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &header) != nil || header.Backup == 0 {
+		return 0, errors.New("Backup has no header")
+	}
+	if header.Backup != backupFormat {
+		return 0, fmt.Errorf("Backup format %d is not supported", header.Backup)
+	}
+	if header.SchemaVersion > len(migrations) {
+		return 0, fmt.Errorf("Backup is of schema version %d, newer than %d of this server", header.SchemaVersion, len(migrations))
+	}
+
+	db, err := initDB()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if replace {
+		for i := len(backupTables) - 1; i >= 0; i-- {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+backupTables[i]); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		var n int
+		if err := tx.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM messages) + (SELECT COUNT(*) FROM messages_archive)").Scan(&n); err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return 0, errors.New("The database already has messages, restore with -replace to delete them first")
+		}
+	}
+
+	var table string
+	var columns []string
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		row := "(" + placeholders(len(columns)) + ")"
+		values := strings.Repeat(", "+row, len(batch)/len(columns))[2:]
+		_, err := tx.ExecContext(ctx, "INSERT INTO "+table+"(`"+strings.Join(columns, "`, `")+"`) VALUES "+values, batch...)
+		batch = batch[:0]
+		return err
+	}
+	total := 0
+	for lines.Scan() {
+		line := lines.Bytes()
+		if len(line) > 0 && line[0] == '[' {
+			if table == "" {
+				return total, errors.New("Backup has rows before a table")
+			}
+			row, err := restoreRow(line, len(columns))
+			if err != nil {
+				return total, fmt.Errorf("%s row %d: %v", table, total+1, err)
+			}
+			batch = append(batch, row...)
+			if total++; len(batch) >= restoreBatch*len(columns) {
+				if err := flush(); err != nil {
+					return total, fmt.Errorf("restoring %s: %v", table, err)
+				}
+			}
+			continue
+		}
+		var next backupLine
+		if err := json.Unmarshal(line, &next); err != nil {
+			return total, fmt.Errorf("Backup line is not valid: %v", err)
+		}
+		if err := flush(); err != nil {
+			return total, fmt.Errorf("restoring %s: %v", table, err)
+		}
+		if next.End {
+			if next.Rows != total {
+				return total, fmt.Errorf("Backup has %d rows but says %d", total, next.Rows)
+			}
+			return total, commit(tx)
+		}
+		known := false
+		for _, t := range backupTables {
+			known = known || t == next.Table
+		}
+		if !known || len(next.Columns) == 0 {
+			return total, fmt.Errorf("Backup has unknown table %q", next.Table)
+		}
+		for _, c := range next.Columns {
+			if !backupColumn.MatchString(c) {
+				return total, fmt.Errorf("Backup has invalid column %q", c)
+			}
+		}
+		table, columns = next.Table, next.Columns
+	}
+	if err := lines.Err(); err != nil {
+		return total, err
+	}
+	return total, errors.New("Backup is cut off, it has no end")
+}
+
+func restoreRow(line []byte, columns int) ([]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	var row []interface{}
+	if err := dec.Decode(&row); err != nil {
+		return nil, err
+	}
+	if len(row) != columns {
+		return nil, fmt.Errorf("has %d values for %d columns", len(row), columns)
+	}
+	for i, v := range row {
+		switch v := v.(type) {
+		case json.Number:
+			row[i] = v.String()
+		case map[string]interface{}:
+			s, _ := v["base64"].(string)
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("value %d is not valid base64", i+1)
+			}
+			row[i] = b
+		}
+	}
+	return row, nil
+}
+
+// backup writes a backup now, as -schedule backup= does.
+func backup(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if err := configure(); err != nil {
+		return err
+	}
+	defer closeDB()
+	key, rows, err := backupDatabase(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %d rows to %s\n", rows, key)
+	return nil
+}
+
+// restore loads a backup from the blob store, the latest unless -key names
+// one, or from a local -file.
+func restore(fs *flag.FlagSet, args []string) error {
+	key := fs.String("key", "", "Key of the backup in the blob store, the latest when empty")
+	file := fs.String("file", "", "Local backup file to restore instead of one in the blob store")
+	replace := fs.Bool("replace", false, "Delete the rows of the backed up tables first, a database with messages is refused otherwise")
+	fs.Parse(args)
+	if err := configure(); err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx := context.Background()
+	var r io.ReadCloser
+	source := *file
+	if source != "" {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		r = f
+	} else {
+		if source = *key; source == "" {
+			keys, err := listBackups(ctx)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				return fmt.Errorf("There are no backups below %q", backup_prefix)
+			}
+			source = keys[len(keys)-1]
+		}
+		var err error
+		if r, err = blobs.Get(ctx, source); err != nil {
+			return fmt.Errorf("Could not read backup %s: %v", source, err)
+		}
+	}
+	defer r.Close()
+	rows, err := restoreBackup(ctx, r, *replace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d rows from %s\n", rows, source)
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type batchRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type batchResponse struct {
+	Messages []messageType `json:"messages"`
+	Missing  []string      `json:"missing"`
+}
+
+// batchGetMessages handles POST /messages/batch-get, returning the messages
+// with the given ids in the order they were asked for, and the ids that do
+// not exist in the channel, or are held for review, as missing.
+func batchGetMessages() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "Only POST method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		var req batchRequest
+		if err := decodeJSON(r.Body, &req); err != nil {
+			bodyError(rw, err)
+			return
+		}
+		if len(req.IDs) == 0 {
+			http.Error(rw, "ids are required!", http.StatusBadRequest)
+			return
+		}
+		if len(req.IDs) > batch_max_ids {
+			http.Error(rw, fmt.Sprintf("At most %d ids may be asked for at once!", batch_max_ids), http.StatusBadRequest)
+			return
+		}
+		zone, err := displayZone(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := parseFields(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ids []string
+		args := []interface{}{channelOf(r).name}
+		seen := map[string]bool{}
+		for _, s := range req.IDs {
+			id, err := parseID(s)
+			if err != nil {
+				http.Error(rw, "ids must be message ids!", http.StatusBadRequest)
+				return
+			}
+			s = formatID(id)
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			ids = append(ids, s)
+			args = append(args, id)
+		}
+
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		selectClause, groupClause := f.query()
+		query := selectClause + " WHERE m.channel = ? AND m.flagged = 0 AND m.id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")" + groupClause
+		found := map[string]messageType{}
+		err = withRetry(r.Context(), "batch_get_messages", func() error {
+			qctx, cancel := queryDeadline(r.Context())
+			defer cancel()
+			rows, err := db.QueryContext(qctx, query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var msg messageType
+				var tags, keyID sql.NullString
+				if err := f.scanMessage(rows.Scan, &msg, &tags, &keyID); err != nil {
+					return err
+				}
+				found[msg.Id] = msg
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get messages from db")
+			return
+		}
+
+		out := batchResponse{Messages: []messageType{}, Missing: []string{}}
+		for _, id := range ids {
+			if msg, ok := found[id]; ok {
+				out.Messages = append(out.Messages, msg)
+			} else {
+				out.Missing = append(out.Missing, id)
+			}
+		}
+		if err = loadDetails(r.Context(), db, out.Messages, channelOf(r).prefix(), f); err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get messages from db")
+			return
+		}
+		inZone(out.Messages, zone)
+		messages, err := f.shape(jsonCodec, out.Messages)
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to encode messages", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(struct {
+			Messages interface{} `json:"messages"`
+			Missing  []string    `json:"missing"`
+		}{messages, out.Missing})
+	})
+}
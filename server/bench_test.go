@@ -0,0 +1,166 @@
+package server
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchDriver is a database/sql driver answering the queries of the hot
+// paths from memory, so the benchmarks measure the server and not MySQL.
+// Message listings return benchRowCount messages, every other query no rows.
+type benchDriver struct{}
+
+type benchConn struct{}
+
+type benchStmt struct{ query string }
+
+type benchRows struct {
+	n, i int
+}
+
+type benchResult struct{}
+
+var benchRowCount = 100
+
+var benchInsertID int64
+
+// The columns are shared by every row, database/sql copies them out.
+var (
+	benchTimestamp = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	benchBody      = []byte("Deploy went out without a hitch, see the **docs** for the details")
+	benchTags      = []byte("ops,release")
+)
+
+func (benchDriver) Open(string) (driver.Conn, error) { return benchConn{}, nil }
+
+func (benchConn) Prepare(query string) (driver.Stmt, error) { return benchStmt{query}, nil }
+func (benchConn) Close() error                              { return nil }
+func (benchConn) Begin() (driver.Tx, error)                 { return benchConn{}, nil }
+func (benchConn) Commit() error                             { return nil }
+func (benchConn) Rollback() error                           { return nil }
+
+func (benchStmt) Close() error  { return nil }
+func (benchStmt) NumInput() int { return -1 }
+
+func (benchStmt) Exec([]driver.Value) (driver.Result, error) { return benchResult{}, nil }
+
+func (s benchStmt) Query([]driver.Value) (driver.Rows, error) {
+	if strings.HasPrefix(s.query, selectMessages) {
+		return &benchRows{n: benchRowCount}, nil
+	}
+	return &benchRows{}, nil
+}
+
+func (benchResult) LastInsertId() (int64, error) { return atomic.AddInt64(&benchInsertID, 1), nil }
+func (benchResult) RowsAffected() (int64, error) { return 1, nil }
+
+func (*benchRows) Columns() []string {
+	return []string{"id", "message", "timestamp", "modified", "version", "tags", "key_id"}
+}
+
+func (*benchRows) Close() error { return nil }
+
+func (r *benchRows) Next(dest []driver.Value) error {
+	if r.i >= r.n {
+		return io.EOF
+	}
+	r.i++
+	dest[0] = int64(r.i)
+	dest[1] = benchBody
+	dest[2] = benchTimestamp
+	dest[3] = int64(1622548800)
+	dest[4] = int64(1)
+	dest[5] = benchTags
+	dest[6] = nil
+	return nil
+}
+
+func init() {
+	sql.Register("bench", benchDriver{})
+}
+
+// setupBench configures the server with the default flags and swaps the
+// pools for the in-memory driver.
+func setupBench(b *testing.B) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse(nil); err != nil {
+		b.Fatal(err)
+	}
+	if err := configure(); err != nil {
+		b.Fatal(err)
+	}
+	db, err := sql.Open("bench", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	poolsMu.Lock()
+	primaryDB, replicaDB = db, nil
+	poolsMu.Unlock()
+	atomic.StoreInt32(&schemaReady, 1)
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+}
+
+func BenchmarkListMessages(b *testing.B) {
+	setupBench(b)
+	h := listMessages()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/messages?limit=100", nil))
+		if rw.Code != http.StatusOK {
+			b.Fatal(rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func BenchmarkAddMessage(b *testing.B) {
+	setupBench(b)
+	h := addMessage()
+	body := `{"message":"Deploy went out without a hitch","tags":["ops","release"]}`
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/add?access_key="+access_key, strings.NewReader(body))
+		h.ServeHTTP(rw, r)
+		if rw.Code != http.StatusOK {
+			b.Fatal(rw.Code, rw.Body.String())
+		}
+	}
+}
+
+// BenchmarkMiddleware measures the chain every request passes through in
+// front of the router.
+func BenchmarkMiddleware(b *testing.B) {
+	setupBench(b)
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	nop := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	h := tracing(nextRequestID)(logging(logger)(capturing(logger)(limiting(max_concurrent, max_queued, queue_timeout)(nop))))
+	r := httptest.NewRequest("GET", "/health", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func BenchmarkRequestID(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = nextRequestID()
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errStoreDown is returned instead of touching the database while the
+// breaker is open.
+var errStoreDown = errors.New("database is unavailable")
+
+var (
+	breakerOpened = newCounter("mysql_breaker_opened_total", "Times the circuit breaker opened after the database became unreachable.")
+	staleServed   = newCounter("stale_responses_total", "Listings served from the last known response while the database was unreachable.")
+)
+
+// A circuitBreaker stops requests from piling up on a database that is not
+// reachable. After -breaker_failures consecutive connection failures it
+// opens and every storage operation fails fast with errStoreDown. Once
+// -breaker_cooldown has passed one operation is let through as a probe; its
+// outcome closes the breaker again or keeps it open for another cooldown.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+var breaker circuitBreaker
+
+func init() {
+	newGaugeFunc("mysql_breaker_open", "Whether the circuit breaker around the database is open.", nil, func() []sample {
+		if _, open := breaker.state(); open {
+			return []sample{{value: 1}}
+		}
+		return []sample{{value: 0}}
+	})
+}
+
+// allow reports whether a storage operation may run.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < breaker_cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record feeds the outcome of a storage operation to the breaker. Only
+// connection failures count, a query that fails on a healthy server does not
+// say anything about its availability.
+func (b *circuitBreaker) record(err error) {
+	down := err != nil && unreachable(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !down {
+		b.failures = 0
+		b.open = false
+		return
+	}
+	b.failures++
+	if b.open || b.failures >= breaker_failures {
+		if !b.open {
+			breakerOpened.inc()
+		}
+		b.open = true
+		b.openedAt = time.Now()
+	}
+}
+
+// state returns how long until the breaker lets a probe through, and whether
+// it is open at all.
+func (b *circuitBreaker) state() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return 0, false
+	}
+	return breaker_cooldown - time.Since(b.openedAt), true
+}
+
+// unreachable reports whether an error means the database could not be
+// reached at all.
+func unreachable(err error) bool {
+	return errors.Is(err, errStoreDown) || brokenConnection(err)
+}
+
+// storeError answers a request whose storage operation failed: with 503 and
+// Retry-After while the database is unreachable, with 500 and msg otherwise.
+func storeError(rw http.ResponseWriter, err error, msg string) {
+	if !unreachable(err) {
+		http.Error(rw, msg, http.StatusInternalServerError)
+		return
+	}
+	wait, _ := breaker.state()
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+	http.Error(rw, "Database is unavailable, try again later", http.StatusServiceUnavailable)
+}
+
+// serveStale answers a listing whose storage operation failed with its last
+// known response while the database is unreachable, and like storeError when
+// there is none.
+func serveStale(rw http.ResponseWriter, err error, key, msg string) {
+	if unreachable(err) && lastKnown.serve(rw, key) {
+		return
+	}
+	storeError(rw, err, msg)
+}
+
+// staleCache keeps the last successful response of each listing so it can be
+// served while the database is down.
+type staleCache struct {
+	mu      sync.Mutex
+	entries map[string]*staleEntry
+}
+
+type staleEntry struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+var lastKnown = staleCache{entries: map[string]*staleEntry{}}
+
+// staleHeaders are the headers describing the content of a listing, kept
+// with its body. The others, like X-Request-Id, belong to the request that
+// is being answered and are set by the middleware.
+var staleHeaders = []string{"Content-Type", "ETag", "Last-Modified", "Link", "Deprecation", "Sunset"}
+
+func (c *staleCache) put(key string, header http.Header, body []byte) {
+	if stale_cache_entries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= stale_cache_entries {
+		// Make room by dropping the entry that was refreshed longest ago.
+		var oldest string
+		for k, e := range c.entries {
+			if oldest == "" || e.at.Before(c.entries[oldest].at) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	kept := http.Header{}
+	for _, name := range staleHeaders {
+		for _, v := range header.Values(name) {
+			kept.Add(name, v)
+		}
+	}
+	// The body is copied, callers encode into pooled buffers.
+	c.entries[key] = &staleEntry{header: kept, body: append([]byte(nil), body...), at: time.Now()}
+}
+
+// serve writes the last known response for key, marked as stale, and
+// reports whether there was one.
+func (c *staleCache) serve(rw http.ResponseWriter, key string) bool {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	staleServed.inc()
+	for k, v := range e.header {
+		rw.Header()[k] = v
+	}
+	rw.Header().Set("Age", strconv.Itoa(int(time.Since(e.at).Seconds())))
+	rw.Header().Set("Warning", `110 - "Response is Stale"`)
+	rw.Header().Set("X-Stale-Since", e.at.UTC().Format(http.TimeFormat))
+	rw.Write(e.body)
+	return true
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStaleCacheHeaders(t *testing.T) {
+	defer func(n int) { stale_cache_entries = n }(stale_cache_entries)
+	stale_cache_entries = 10
+	c := staleCache{entries: map[string]*staleEntry{}}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("ETag", `"3"`)
+	header.Set("Link", `</messages?after_id=2&limit=2>; rel="next"`)
+	header.Set("X-Request-Id", "old")
+	header.Set("X-Features", "envelope")
+	header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	c.put("key", header, []byte("[]"))
+
+	rw := httptest.NewRecorder()
+	rw.Header().Set("X-Request-Id", "new")
+	if !c.serve(rw, "key") {
+		t.Fatal("nothing served")
+	}
+	want := map[string]string{
+		"Content-Type": "application/json",
+		"ETag":         `"3"`,
+		"Link":         `</messages?after_id=2&limit=2>; rel="next"`,
+		"X-Request-Id": "new",
+		"X-Features":   "",
+		"Traceparent":  "",
+		"Warning":      `110 - "Response is Stale"`,
+	}
+	for name, v := range want {
+		if got := rw.Header().Get(name); got != v {
+			t.Errorf("%s = %q, want %q", name, got, v)
+		}
+	}
+	if rw.Body.String() != "[]" {
+		t.Errorf("body = %q", rw.Body.String())
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+)
+
+// Body capture logs the request and response bodies of failing requests to
+// make problems in production reproducible. It is off unless started with
+// -capture_bodies or switched on at /admin/capture, and only keeps the first
+// -capture_max_bytes of each body.
+var captureEnabled int32
+
+// secretFields matches keys and values of JSON and form bodies that must not
+// end up in logs.
+var secretFields = regexp.MustCompile(`(?i)("?[a-z_]*(?:key|secret|password|token|signature)"?\s*[:=]\s*)("[^"]*"|[^&\s,}]*)`)
+
+func redactSecrets(body string) string {
+	return secretFields.ReplaceAllString(body, `${1}"[REDACTED]"`)
+}
+
+// redactURL masks the values of query parameters holding keys.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	for name := range q {
+		if secretFields.MatchString(name + "=") {
+			q.Set(name, "REDACTED")
+		}
+	}
+	out := *u
+	out.RawQuery = q.Encode()
+	return out.RequestURI()
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - len(b.buf); room < len(p) {
+		b.buf = append(b.buf, p[:room]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	s := redactSecrets(string(b.buf))
+	if b.truncated {
+		s += "...(truncated)"
+	}
+	return s
+}
+
+type teeBody struct {
+	io.ReadCloser
+	tee io.Writer
+}
+
+func (t teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.tee.Write(p[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   limitedBuffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func capturing(logger *log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&captureEnabled) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			reqBody := &limitedBuffer{max: capture_max_bytes}
+			if r.Body != nil {
+				r.Body = teeBody{ReadCloser: r.Body, tee: reqBody}
+			}
+			cw := &captureWriter{ResponseWriter: w, body: limitedBuffer{max: capture_max_bytes}}
+			next.ServeHTTP(cw, r)
+			if cw.status < 400 {
+				return
+			}
+			// Handlers that fail early leave the body unread.
+			if r.Body != nil {
+				io.CopyN(io.Discard, r.Body, int64(capture_max_bytes))
+			}
+			requestID := requestIDOf(r.Context())
+			logger.Printf("%s captured %s %s %d request=%q response=%q\n", requestID, r.Method, redactURL(r.URL), cw.status, reqBody, &cw.body)
+		})
+	}
+}
+
+// captureToggle serves /admin/capture: GET tells whether body capture is on,
+// POST with ?enabled=true or false switches it.
+func captureToggle() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(rw, r) {
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(rw, "enabled must be true or false!", http.StatusBadRequest)
+				return
+			}
+			var v int32
+			if enabled {
+				v = 1
+			}
+			atomic.StoreInt32(&captureEnabled, v)
+			log.Println("Body capture enabled:", enabled)
+		default:
+			rw.Header().Set("Allow", "GET, POST")
+			http.Error(rw, "Only GET and POST methods are allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"enabled":   atomic.LoadInt32(&captureEnabled) == 1,
+			"max_bytes": capture_max_bytes,
+		})
+	})
+}
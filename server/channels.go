@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// A channel is an independent message board with its own access key. Every
+// message belongs to exactly one channel and every query is scoped to the
+// channel of the request. The routes at the root of the server serve the
+// default channel, the same routes below /channels/{name} serve the others.
+type channel struct {
+	name string
+	// key holds the access key as a string. It changes when the access key
+	// of the default channel is reloaded.
+	key atomic.Value
+}
+
+func newChannel(name, key string) *channel {
+	c := &channel{name: name}
+	c.key.Store(key)
+	return c
+}
+
+func (c *channel) accessKey() string {
+	return c.key.Load().(string)
+}
+
+const defaultChannel = "default"
+
+var channelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var channels map[string]*channel
+
+// parseChannels parses the -channels flag, a comma separated list of
+// name=access_key pairs. The default channel always exists and uses
+// -access_key.
+func parseChannels(spec string) (map[string]*channel, error) {
+	out := map[string]*channel{defaultChannel: newChannel(defaultChannel, access_key)}
+	for _, entry := range splitList(spec) {
+		i := strings.IndexByte(entry, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("channel %q needs an access key, use name=key", entry)
+		}
+		name, key := entry[:i], entry[i+1:]
+		if !channelPattern.MatchString(name) {
+			return nil, fmt.Errorf("channel name %q is not valid", name)
+		}
+		if _, ok := out[name]; ok {
+			return nil, fmt.Errorf("channel %q is configured twice", name)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("channel %q needs an access key", name)
+		}
+		out[name] = newChannel(name, key)
+	}
+	return out, nil
+}
+
+// channelOf returns the channel a request is for.
+func channelOf(r *http.Request) *channel {
+	if c, ok := r.Context().Value(channelKey).(*channel); ok {
+		return c
+	}
+	return channels[defaultChannel]
+}
+
+// prefix is the path the routes of the channel are mounted at, below
+// -base_path.
+func (c *channel) prefix() string {
+	if c.name == defaultChannel {
+		return base_path
+	}
+	return base_path + "/channels/" + c.name
+}
+
+// channelRoutes serves /channels/{name}/... by passing the request on to the
+// message routes with the channel in its context and the prefix removed from
+// its path.
+func channelRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/channels/")
+		name := rest
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			name, rest = rest[:i], rest[i:]
+		} else {
+			rest = "/"
+		}
+		c, ok := channels[name]
+		if !ok || name == defaultChannel {
+			http.Error(rw, "Channel not found", http.StatusNotFound)
+			return
+		}
+		u := *r.URL
+		u.Path, u.RawPath = rest, ""
+		r2 := r.WithContext(context.WithValue(r.Context(), channelKey, c))
+		r2.URL = &u
+		next.ServeHTTP(rw, r2)
+	})
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Fault injection lets clients test their retries against this server. It
+// is only installed with -chaos; the rules of which faults to inject where
+// are set at /admin/chaos and start out empty, so nothing happens until
+// they are.
+
+// chaosRoute is exempt from faults so they can always be switched off.
+const chaosRoute = "/admin/chaos"
+
+var chaosFaults = newCounter("chaos_faults_total", "Faults injected by -chaos, by fault.", "fault")
+
+// A chaosRule injects faults into the requests to Route, a path like
+// /messages or, ending in a slash, every path below it like /messages/.
+// Each fault is decided on independently with its probability.
+type chaosRule struct {
+	Route string `json:"route"`
+	// LatencyMS is added before the request is served.
+	LatencyMS          int     `json:"latency_ms,omitempty"`
+	LatencyProbability float64 `json:"latency_probability,omitempty"`
+	// ErrorStatus, 503 by default, is answered instead of serving the
+	// request.
+	ErrorStatus      int     `json:"error_status,omitempty"`
+	ErrorProbability float64 `json:"error_probability,omitempty"`
+	// Dropped requests have the connection closed without a response.
+	DropProbability float64 `json:"drop_probability,omitempty"`
+}
+
+func (c chaosRule) validate() error {
+	if !strings.HasPrefix(c.Route, "/") {
+		return fmt.Errorf("route %q must start with /!", c.Route)
+	}
+	for _, p := range []struct {
+		name  string
+		value float64
+	}{
+		{"latency_probability", c.LatencyProbability},
+		{"error_probability", c.ErrorProbability},
+		{"drop_probability", c.DropProbability},
+	} {
+		if p.value < 0 || p.value > 1 {
+			return fmt.Errorf("%s of %s must be between 0 and 1!", p.name, c.Route)
+		}
+	}
+	if c.LatencyMS < 0 || c.LatencyMS > 60000 {
+		return fmt.Errorf("latency_ms of %s must be between 0 and 60000!", c.Route)
+	}
+	if c.ErrorStatus != 0 && (c.ErrorStatus < 500 || c.ErrorStatus > 599) {
+		return fmt.Errorf("error_status of %s must be a 5xx status!", c.Route)
+	}
+	return nil
+}
+
+func (c chaosRule) matches(path string) bool {
+	if strings.HasSuffix(c.Route, "/") {
+		return strings.HasPrefix(path, c.Route)
+	}
+	return path == c.Route
+}
+
+// chaosRules holds the []chaosRule in effect.
+var chaosRules atomic.Value
+
+// chaosRuleFor is the rule with the longest route matching path.
+func chaosRuleFor(path string) (chaosRule, bool) {
+	rules, _ := chaosRules.Load().([]chaosRule)
+	var best chaosRule
+	found := false
+	for _, rule := range rules {
+		if rule.matches(path) && (!found || len(rule.Route) > len(best.Route)) {
+			best, found = rule, true
+		}
+	}
+	return best, found
+}
+
+func injectFaults(enabled bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(r.URL.Path, base_path)
+			rule, ok := chaosRuleFor(path)
+			if !ok || path == chaosRoute {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if rule.LatencyMS > 0 && rand.Float64() < rule.LatencyProbability {
+				chaosFaults.inc("latency")
+				timer := time.NewTimer(time.Duration(rule.LatencyMS) * time.Millisecond)
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+			if rand.Float64() < rule.DropProbability {
+				chaosFaults.inc("drop")
+				// The server closes the connection of a handler aborting
+				// before it wrote anything, the client sees it reset.
+				panic(http.ErrAbortHandler)
+			}
+			if rand.Float64() < rule.ErrorProbability {
+				chaosFaults.inc("error")
+				status := rule.ErrorStatus
+				if status == 0 {
+					status = http.StatusServiceUnavailable
+				}
+				w.Header().Set("X-Chaos", "error")
+				http.Error(w, "Injected fault!", status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// chaosAdmin serves /admin/chaos: GET lists the fault injection rules, POST
+// replaces them with the ones in the body, DELETE removes them all.
+func chaosAdmin() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(rw, r) {
+			return
+		}
+		if !chaos {
+			http.Error(rw, "Fault injection is disabled, start the server with -chaos", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Rules []chaosRule `json:"rules"`
+			}
+			if err := decodeJSON(r.Body, &req); err != nil {
+				bodyError(rw, err)
+				return
+			}
+			for _, rule := range req.Rules {
+				if err := rule.validate(); err != nil {
+					http.Error(rw, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			chaosRules.Store(req.Rules)
+			log.Println("Fault injection rules set:", len(req.Rules))
+		case "DELETE":
+			chaosRules.Store([]chaosRule(nil))
+			log.Println("Fault injection rules removed")
+		default:
+			rw.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(rw, "Only GET, POST and DELETE methods are allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		rules, _ := chaosRules.Load().([]chaosRule)
+		if rules == nil {
+			rules = []chaosRule{}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{"rules": rules})
+	})
+}
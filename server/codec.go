@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A codec encodes response bodies and decodes request bodies in one content
+// type. Listings and single messages are sent in the codec the Accept header
+// asks for, message bodies are read in the codec of their Content-Type.
+type codec struct {
+	contentType string
+	aliases     []string
+	encode      func(w io.Writer, v interface{}) error
+	decode      func(r io.Reader, v interface{}) error
+}
+
+var errUnsupportedBody = errors.New("body cannot be encoded in this content type")
+
+var jsonCodec = &codec{
+	contentType: "application/json",
+	encode:      func(w io.Writer, v interface{}) error { return json.NewEncoder(w).Encode(v) },
+	decode:      decodeJSON,
+}
+
+// bufferPool holds the buffers responses are encoded into before they are
+// written. Buffers that grew past 1MB are left to the garbage collector.
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= 1<<20 {
+		bufferPool.Put(buf)
+	}
+}
+
+var codecs = []*codec{jsonCodec, msgpackCodec, protobufCodec}
+
+func codecFor(mediaType string) *codec {
+	for _, c := range codecs {
+		if mediaType == c.contentType {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if mediaType == alias {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// responseCodec picks the codec of the first type in the Accept header that
+// has one. Clients asking for nothing known get JSON as before.
+func responseCodec(r *http.Request) *codec {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+		if c := codecFor(mediaType); c != nil {
+			return c
+		}
+	}
+	return jsonCodec
+}
+
+// requestCodec picks the codec of the Content-Type of a request. Bodies of
+// any other type are read as JSON, as they were before codecs existed.
+func requestCodec(r *http.Request) *codec {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if c := codecFor(mediaType); c != nil {
+		return c
+	}
+	return jsonCodec
+}
+
+// toGeneric turns v into the maps, slices and scalars its JSON encoding
+// decodes to, so codecs without a schema honour the json tags of the types.
+func toGeneric(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var out interface{}
+	err = dec.Decode(&out)
+	return out, err
+}
+
+// fromGeneric stores a decoded generic value in v the way decodeJSON
+// would.
+func fromGeneric(g interface{}, v interface{}) error {
+	b, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(bytes.NewReader(b), v)
+}
+
+// A decodeError says what is wrong with a request body, in a way the client
+// can fix it.
+type decodeError struct {
+	msg string
+}
+
+func (e *decodeError) Error() string { return e.msg }
+
+// decodeJSON decodes a request body holding one JSON value into v. Fields v
+// does not have are refused rather than ignored, so misspelled ones do not
+// go unnoticed.
+func decodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if _, extra := dec.Token(); extra != io.EOF {
+			return &decodeError{"Body must hold a single JSON value!"}
+		}
+		return nil
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == io.EOF:
+		return &decodeError{"Body is empty!"}
+	case err == io.ErrUnexpectedEOF:
+		return &decodeError{"Body ends in the middle of the JSON!"}
+	case errors.As(err, &syntaxErr):
+		return &decodeError{fmt.Sprintf("Body is not valid JSON at offset %d: %s!", syntaxErr.Offset, strings.TrimPrefix(syntaxErr.Error(), "json: "))}
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return &decodeError{fmt.Sprintf("Body must be %s, not %s!", jsonKind(typeErr.Type), jsonValue(typeErr.Value))}
+		}
+		return &decodeError{fmt.Sprintf("Field %q must be %s, not %s!", typeErr.Field, jsonKind(typeErr.Type), jsonValue(typeErr.Value))}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return &decodeError{fmt.Sprintf("Unknown field %s!", strings.TrimPrefix(err.Error(), "json: unknown field "))}
+	}
+	return err
+}
+
+// jsonKind names what JSON value decodes into t.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Ptr:
+		return jsonKind(t.Elem())
+	}
+	return "a number"
+}
+
+// jsonValue names a JSON value as UnmarshalTypeError describes it.
+func jsonValue(value string) string {
+	switch value {
+	case "bool":
+		return "true or false"
+	case "array", "object":
+		return "an " + value
+	case "number", "string":
+		return "a " + value
+	}
+	return value
+}
+
+// bodyError answers a request whose body could not be decoded.
+func bodyError(rw http.ResponseWriter, err error) {
+	var decodeErr *decodeError
+	switch {
+	case err == errUnsupportedBody:
+		http.Error(rw, "Body cannot be sent in this content type!", http.StatusUnsupportedMediaType)
+	case errors.As(err, &decodeErr):
+		http.Error(rw, decodeErr.msg, http.StatusBadRequest)
+	case strings.Contains(err.Error(), "request body too large"):
+		http.Error(rw, "Body is too large!", http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(rw, "Unable to read body!", http.StatusBadRequest)
+	}
+}
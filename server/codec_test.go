@@ -0,0 +1,32 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    string
+		wantErr string
+	}{
+		{body: `{"message":"hi","tags":["ops"]}`, want: "hi"},
+		{body: `{"message":"hi"}`, want: "hi"},
+		{body: `{"message":"hi","id":"5"}`, wantErr: `Unknown field "id"!`},
+		{body: `{"message":"hi","created_at":"2026-10-14T07:00:00Z"}`, wantErr: `Unknown field "created_at"!`},
+		{body: `{"message":"hi","created_at":"yesterday"}`, wantErr: `Unknown field "created_at"!`},
+		{body: `{"message":"hi","reactions":{"+1":3}}`, wantErr: `Unknown field "reactions"!`},
+		{body: `{"message":"hi","attachments":[]}`, wantErr: `Unknown field "attachments"!`},
+		{body: `{"message":5}`, wantErr: `Field "message" must be a string, not a number!`},
+		{body: `{"message":"hi"} {}`, wantErr: "Body must hold a single JSON value!"},
+	}
+	for _, tt := range tests {
+		msg, err := decodeMessage(jsonCodec, strings.NewReader(tt.body))
+		if got := errString(err); got != tt.wantErr {
+			t.Errorf("%s: error = %q, want %q", tt.body, got, tt.wantErr)
+		} else if err == nil && msg.Message != tt.want {
+			t.Errorf("%s: message = %q, want %q", tt.body, msg.Message, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// migrate applies pending schema migrations, for deployments that run
+// them ahead of starting the server with -auto_migrate=false.
+func migrate(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if err := loadSecrets(); err != nil {
+		return err
+	}
+	if err := openDB(); err != nil {
+		return err
+	}
+	defer closeDB()
+	primary, _ := currentPools()
+	applied, err := applyMigrations(primary, func(v ...interface{}) { fmt.Println(v...) })
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Applied %d migrations, the schema is at version %d\n", applied, len(migrations))
+	return nil
+}
+
+var seedMessages = []struct {
+	message string
+	tags    []string
+}{
+	{"Hello, world!", []string{"greeting"}},
+	{"Is anyone **out** there?", nil},
+	{"Deploy went out without a hitch", []string{"ops", "release"}},
+	{"Lunch at noon?", []string{"food"}},
+	{"See the [docs](https://github.com/itzmanish/simple-http-server-go) for the API", []string{"docs"}},
+	{"Reminder: rotate the access keys", []string{"ops"}},
+}
+
+// seed inserts sample messages into a channel, cycling through
+// seedMessages.
+func seed(fs *flag.FlagSet, args []string) error {
+	count := fs.Int("count", len(seedMessages), "Number of messages to insert")
+	channelName := fs.String("channel", defaultChannel, "Channel the messages are inserted into")
+	fs.Parse(args)
+	if err := configure(); err != nil {
+		return err
+	}
+	defer closeDB()
+	c, ok := channels[*channelName]
+	if !ok {
+		return fmt.Errorf("Channel %q is not configured", *channelName)
+	}
+	db, err := initDB()
+	if err != nil {
+		return err
+	}
+	inserted := 0
+	for i := 0; i < *count; i++ {
+		sample := seedMessages[i%len(seedMessages)]
+		msg := messageType{Message: sample.message, Tags: sample.tags, Channel: c.name}
+		if i >= len(seedMessages) {
+			msg.Message = fmt.Sprintf("%s (#%d)", msg.Message, i/len(seedMessages)+1)
+		}
+		msg.ContentHash = contentHash(c.name, c.accessKey(), msg.Message)
+		// Messages seeded before are skipped.
+		var dup *duplicateError
+		err := insertMessage(db, msg, nil)
+		if errors.As(err, &dup) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		inserted++
+	}
+	fmt.Printf("Inserted %d messages into channel %s\n", inserted, c.name)
+	return nil
+}
+
+// checkConfig validates the flags and that the databases can be reached,
+// exiting non-zero on the first problem.
+func checkConfig(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if err := configure(); err != nil {
+		return err
+	}
+	defer closeDB()
+	primary, replica := currentPools()
+	if err := pingPool(primary); err != nil {
+		return fmt.Errorf("Could not connect to -mysql_dsn: %v", err)
+	}
+	fmt.Println("-mysql_dsn is reachable")
+	if replica != nil {
+		if err := pingPool(replica); err != nil {
+			return fmt.Errorf("Could not connect to -mysql_read_dsn: %v", err)
+		}
+		fmt.Println("-mysql_read_dsn is reachable")
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+func pingPool(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return db.PingContext(ctx)
+}
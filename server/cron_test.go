@@ -0,0 +1,101 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 * * * *", false},
+		{"0 9-17 * * 1-5", false},
+		{"0,30 */2 1,15 * *", false},
+		{"5/10 * * * *", false},
+		{"0 0 * * 7", false},
+		{"@daily", false},
+		{"@every 10m", false},
+		{"  @hourly  ", false},
+		{"@every 500ms", true},
+		{"@every soon", true},
+		{"@sometimes", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"*/x * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+		{"1-b * * * *", true},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec, from, want string
+	}{
+		// Steps and ranges.
+		{"*/15 * * * *", "2026-10-14 07:01:30", "2026-10-14 07:15:00"},
+		{"*/15 * * * *", "2026-10-14 07:45:00", "2026-10-14 08:00:00"},
+		{"5/20 * * * *", "2026-10-14 07:26:00", "2026-10-14 07:45:00"},
+		{"0 9-17 * * *", "2026-10-14 17:30:00", "2026-10-15 09:00:00"},
+		{"0 10-16/3 * * *", "2026-10-14 13:00:00", "2026-10-14 16:00:00"},
+		{"30 2 * * *", "2026-12-31 03:00:00", "2027-01-01 02:30:00"},
+		// Descriptors.
+		{"@hourly", "2026-10-14 07:59:59", "2026-10-14 08:00:00"},
+		{"@daily", "2026-10-14 00:00:00", "2026-10-15 00:00:00"},
+		{"@weekly", "2026-10-14 12:00:00", "2026-10-18 00:00:00"},
+		{"@monthly", "2026-10-14 12:00:00", "2026-11-01 00:00:00"},
+		{"@yearly", "2026-10-14 12:00:00", "2027-01-01 00:00:00"},
+		{"@every 10m", "2026-10-14 07:01:00", "2026-10-14 07:10:00"},
+		// 7 is Sunday like 0, 2026-10-18 is one.
+		{"0 0 * * 7", "2026-10-14 12:00:00", "2026-10-18 00:00:00"},
+		{"0 0 * * 5-7", "2026-10-17 12:00:00", "2026-10-18 00:00:00"},
+		// Days of month and week restricted both match either: the 20th,
+		// a Tuesday, or the next Monday, the 19th.
+		{"0 0 20 * 1", "2026-10-14 12:00:00", "2026-10-19 00:00:00"},
+		{"0 0 15 * 1", "2026-10-14 12:00:00", "2026-10-15 00:00:00"},
+		// One of them restricted has to match.
+		{"0 0 15 * *", "2026-10-15 00:00:00", "2026-11-15 00:00:00"},
+		{"0 0 * * 1", "2026-10-14 12:00:00", "2026-10-19 00:00:00"},
+		{"0 0 31 * *", "2026-11-01 00:00:00", "2026-12-31 00:00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00:00", "2028-02-29 00:00:00"},
+		// Never.
+		{"0 0 30 2 *", "2026-10-14 12:00:00", ""},
+		{"0 0 31 4,6,9,11 *", "2026-10-14 12:00:00", ""},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.spec, err)
+		}
+		got := s.next(at(tt.from))
+		var want time.Time
+		if tt.want != "" {
+			want = at(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q after %s = %s, want %s", tt.spec, tt.from, got, want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Writes go to the primary pool opened from -mysql_dsn. With -mysql_read_dsn
+// reads go to a replica pool instead, unless the replica failed its last
+// health check, in which case they fall back to the primary. The pools are
+// replaced when the DSNs are reloaded, poolsMu guards them.
+var (
+	poolsMu   sync.RWMutex
+	primaryDB *sql.DB
+	replicaDB *sql.DB
+	replicaUp int32
+
+	once        sync.Once
+	schemaReady int32
+)
+
+var (
+	dbReads = newCounter("mysql_reads_total", "Reads served, by the pool that served them.", "pool")
+	// Fallbacks count reads that went to the primary while the replica was down.
+	dbFallbacks = newCounter("mysql_replica_fallbacks_total", "Reads that fell back to the primary because the replica was down.")
+	dbChecks    = newCounter("mysql_replica_checks_total", "Health checks of the replica, by result.", "result")
+)
+
+// openDB opens the connection pools. Connections are made lazily, so this
+// only fails on a malformed DSN.
+func openDB() error {
+	primary, err := newPool(mysql_dsn)
+	if err != nil {
+		return err
+	}
+	var replica *sql.DB
+	if mysql_read_dsn != "" {
+		if replica, err = newPool(mysql_read_dsn); err != nil {
+			primary.Close()
+			return err
+		}
+	}
+	poolsMu.Lock()
+	primaryDB, replicaDB = primary, replica
+	poolsMu.Unlock()
+	registerPoolMetrics()
+	return nil
+}
+
+// reopenDB replaces the pools whose DSN changed. The old pools are closed
+// after a grace period so requests that already hold them can finish.
+func reopenDB(dsn, readDSN string) error {
+	var primary, replica *sql.DB
+	var err error
+	if dsn != "" {
+		if primary, err = newPool(dsn); err != nil {
+			return err
+		}
+	}
+	if readDSN != "" {
+		if replica, err = newPool(readDSN); err != nil {
+			if primary != nil {
+				primary.Close()
+			}
+			return err
+		}
+	}
+	poolsMu.Lock()
+	var retired []*sql.DB
+	if primary != nil {
+		retired = append(retired, primaryDB)
+		primaryDB = primary
+	}
+	if replica != nil {
+		if replicaDB != nil {
+			retired = append(retired, replicaDB)
+		}
+		replicaDB = replica
+	}
+	poolsMu.Unlock()
+	time.AfterFunc(time.Minute, func() {
+		for _, db := range retired {
+			db.Close()
+		}
+	})
+	return nil
+}
+
+// queryer is a pool or a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryDeadline limits a read to -db_query_timeout. Once the deadline or
+// the request context is done the driver gives up on the statement, closing
+// its rows, so a stuck query cannot hold one of the few connections.
+func queryDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db_query_timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db_query_timeout)
+}
+
+// scanMessages runs a listing query, retried as op, and reads all of its
+// rows with scan into messages, closing them before it returns. out stays
+// nil for no rows and has room for capacity messages from the first. A
+// failure part way through the rows is logged with how many were read.
+func scanMessages(ctx context.Context, db queryer, op, query string, args []interface{}, capacity int, scan func(rows *sql.Rows, msg *messageType) error) ([]messageType, error) {
+	var out []messageType
+	err := withRetry(ctx, op, func() error {
+		qctx, cancel := queryDeadline(ctx)
+		defer cancel()
+		rows, err := db.QueryContext(qctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		out = out[:0]
+		for rows.Next() {
+			if out == nil {
+				out = make([]messageType, 0, capacity)
+			}
+			out = append(out, messageType{})
+			if err := scan(rows, &out[len(out)-1]); err != nil {
+				return &partialReadError{rows: len(out) - 1, err: err}
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return &partialReadError{rows: len(out), err: err}
+		}
+		return rows.Close()
+	})
+	var partial *partialReadError
+	if errors.As(err, &partial) {
+		log.Printf("Reading %s failed after %d rows, request %s: %v\n", op, partial.rows, requestIDOf(ctx), partial.err)
+		err = partial.err
+	}
+	return out, err
+}
+
+// partialReadError is a listing that failed after some of its rows were
+// read. It unwraps to the error so transient ones are retried.
+type partialReadError struct {
+	rows int
+	err  error
+}
+
+func (e *partialReadError) Error() string { return e.err.Error() }
+func (e *partialReadError) Unwrap() error { return e.err }
+
+// loadDetails fills in the reactions and attachments of a page of messages
+// the fields ask for, timing both queries like the operation that read the
+// page.
+func loadDetails(ctx context.Context, db queryer, msgs []messageType, prefix string, f fieldSet) error {
+	var err error
+	if f.has("reactions") {
+		err = timed(ctx, "load_reactions", func() error { return loadReactions(ctx, db, msgs) })
+	}
+	if err == nil && f.has("attachments") {
+		err = timed(ctx, "load_attachments", func() error { return loadAttachments(ctx, db, msgs, prefix) })
+	}
+	return err
+}
+
+func currentPools() (primary, replica *sql.DB) {
+	poolsMu.RLock()
+	defer poolsMu.RUnlock()
+	return primaryDB, replicaDB
+}
+
+// newPool opens a pool on dsn. Sessions use UTC whatever the time zone of
+// the database server, and timestamps are scanned into time.Time in UTC.
+func newPool(dsn string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime, cfg.Loc = true, time.UTC
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	// See "Important settings" section.
+	db.SetConnMaxLifetime(time.Minute * 3)
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+	return db, nil
+}
+
+func closeDB() {
+	primary, replica := currentPools()
+	if replica != nil {
+		replica.Close()
+	}
+	if primary != nil {
+		primary.Close()
+	}
+}
+
+// initDB returns the primary pool. With -auto_migrate pending migrations are
+// applied on the first successful connection.
+func initDB() (*sql.DB, error) {
+	primary, _ := currentPools()
+	if atomic.LoadInt32(&schemaReady) == 0 {
+		if !breaker.allow() {
+			return nil, errStoreDown
+		}
+		err := primary.Ping()
+		breaker.record(err)
+		if err != nil {
+			return nil, err
+		}
+		once.Do(func() {
+			if auto_migrate {
+				if _, err := applyMigrations(primary, log.Println); err != nil {
+					log.Println("Could not migrate the schema:", err)
+				}
+			}
+			atomic.StoreInt32(&schemaReady, 1)
+		})
+	}
+	return primary, nil
+}
+
+// waitForDB blocks until the primary is reachable and, with -auto_migrate,
+// migrated, retrying with a growing backoff for at most maxWait.
+func waitForDB(ctx context.Context, logger *log.Logger, maxWait time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	backoff := 500 * time.Millisecond
+	for {
+		primary, _ := currentPools()
+		err := primary.PingContext(ctx)
+		if err == nil && auto_migrate {
+			_, err = applyMigrations(primary, logger.Println)
+		}
+		if err == nil {
+			_, err = initDB()
+		}
+		if err == nil {
+			logger.Println("Database is available")
+			return nil
+		}
+		logger.Println("Waiting for the database:", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+// MySQL errors of migrations whose change is already in place. Schemas
+// created before schema_migrations existed are adopted this way.
+const (
+	errTableExists     = 1050
+	errDuplicateColumn = 1060
+	errDuplicateKey    = 1061
+)
+
+// applyMigrations applies the migrations newer than the version recorded in
+// schema_migrations, recording each one as it succeeds, and returns how many
+// were applied.
+func applyMigrations(db *sql.DB, logf func(...interface{})) (int, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations(version int NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (version));"); err != nil {
+		return 0, err
+	}
+	var current int
+	err := db.QueryRow("SELECT version FROM schema_migrations ORDER BY version DESC LIMIT 1").Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	applied := 0
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if _, err := db.Exec(migrations[i]); err != nil {
+			var mysqlErr *mysql.MySQLError
+			if !errors.As(err, &mysqlErr) || (mysqlErr.Number != errTableExists && mysqlErr.Number != errDuplicateColumn && mysqlErr.Number != errDuplicateKey) {
+				return applied, fmt.Errorf("migration %d: %v", version, err)
+			}
+			logf("Migration", version, "is already in place:", err)
+		}
+		// Another instance may have applied the same migration meanwhile.
+		if _, err := db.Exec("INSERT IGNORE INTO schema_migrations(version) VALUES(?)", version); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// readDB returns the pool reads should use. Handlers that read what they just
+// wrote keep using the primary so they never see a lagging replica.
+func readDB() (*sql.DB, error) {
+	if _, replica := currentPools(); replica != nil {
+		if atomic.LoadInt32(&replicaUp) == 1 {
+			dbReads.inc("replica")
+			return replica, nil
+		}
+		dbFallbacks.inc()
+	}
+	db, err := initDB()
+	if err == nil {
+		dbReads.inc("primary")
+	}
+	return db, err
+}
+
+// replicaChecker pings the replica every -replica_check_interval and marks it
+// up or down.
+func replicaChecker(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(replica_check_interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		pingCtx, cancel := context.WithTimeout(ctx, replica_check_interval)
+		_, replica := currentPools()
+		err := replica.PingContext(pingCtx)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			dbChecks.inc("failure")
+			if atomic.SwapInt32(&replicaUp, 0) == 1 || first {
+				logger.Println("Replica is down, reading from the primary:", err)
+			}
+		} else {
+			dbChecks.inc("success")
+			if atomic.SwapInt32(&replicaUp, 1) == 0 {
+				logger.Println("Replica is up, reading from the replica")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func registerPoolMetrics() {
+	pools := func() map[string]*sql.DB {
+		primary, replica := currentPools()
+		out := map[string]*sql.DB{"primary": primary}
+		if replica != nil {
+			out["replica"] = replica
+		}
+		return out
+	}
+	stat := func(name, help string, value func(sql.DBStats) float64) {
+		newGaugeFunc(name, help, []string{"pool"}, func() []sample {
+			var out []sample
+			for pool, db := range pools() {
+				out = append(out, sample{labels: []string{pool}, value: value(db.Stats())})
+			}
+			return out
+		})
+	}
+	stat("mysql_pool_max_open_connections", "Maximum number of open connections of the pool.", func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	stat("mysql_pool_open_connections", "Open connections of the pool.", func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	stat("mysql_pool_in_use_connections", "Connections of the pool currently in use.", func(s sql.DBStats) float64 { return float64(s.InUse) })
+	stat("mysql_pool_idle_connections", "Idle connections of the pool.", func(s sql.DBStats) float64 { return float64(s.Idle) })
+	stat("mysql_pool_wait_count", "Total number of times the pool was waited on for a connection.", func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	stat("mysql_pool_wait_seconds", "Total time spent waiting for a connection of the pool.", func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+	if mysql_read_dsn != "" {
+		newGaugeFunc("mysql_replica_up", "Whether the replica passed its last health check.", nil, func() []sample {
+			return []sample{{value: float64(atomic.LoadInt32(&replicaUp))}}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// setupStore configures the server with the default flags and args against
+// the MySQL database of TEST_MYSQL_DSN, migrated and emptied. Tests needing
+// a database are skipped without one.
+func setupStore(t *testing.T, args ...string) *sql.DB {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN is not set")
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse(append([]string{"-mysql_dsn", dsn}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := currentPools()
+	if _, err := applyMigrations(db, t.Log); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&schemaReady, 1)
+	for _, table := range []string{"messages", "messages_archive", "message_tags", "tags", "message_events", "usage_counts"} {
+		if _, err := db.Exec("DELETE FROM " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
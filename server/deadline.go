@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Callers from -deadline_trusted can say how long they will wait for an
+// answer, with X-Request-Deadline, an RFC 3339 time or a duration like
+// 1500ms, or a gRPC style Grpc-Timeout like 1500m. The request context ends
+// then, so the database queries and calls to other services made for it
+// give up with the caller, and calls to other services carry the deadline
+// on. A request whose budget is used up before it is answered gets a 504
+// with a JSON error instead of what the handler made of its cancelled work.
+
+var requestDeadlines = newCounter("http_request_deadlines_total", "Requests with a deadline header, by result: honored, exhausted or untrusted.", "result")
+
+var deadlineTrusted []*net.IPNet
+
+// parseTrustedNets parses a comma separated list of CIDRs and addresses.
+func parseTrustedNets(spec string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, entry := range splitList(spec) {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR", entry)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func trustedCaller(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range deadlineTrusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcTimeoutUnits are the units of Grpc-Timeout.
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// requestDeadline reads the deadline of r from its headers, false when it
+// has none.
+func requestDeadline(r *http.Request, now time.Time) (time.Time, bool, error) {
+	if v := strings.TrimSpace(r.Header.Get("X-Request-Deadline")); v != "" {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return time.Time{}, false, errors.New("X-Request-Deadline must be an RFC 3339 time or a duration like 1500ms!")
+		}
+		return now.Add(d), true, nil
+	}
+	if v := strings.TrimSpace(r.Header.Get("Grpc-Timeout")); v != "" {
+		unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if !ok || err != nil || n < 0 || len(v) > 9 {
+			return time.Time{}, false, errors.New("Grpc-Timeout must be up to 8 digits and a unit of H, M, S, m, u or n!")
+		}
+		return now.Add(time.Duration(n) * unit), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// deadlines gives the requests of trusted callers the deadline they sent.
+// The headers of others are ignored.
+func deadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Request-Deadline") == "" && r.Header.Get("Grpc-Timeout") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !trustedCaller(r) {
+			requestDeadlines.inc("untrusted")
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		deadline, _, err := requestDeadline(r, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		budget := deadline.Sub(now)
+		if budget <= 0 {
+			requestDeadlines.inc("exhausted")
+			deadlineExceeded(w, budget)
+			return
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		dw := &deadlineWriter{ResponseWriter: w, ctx: ctx, budget: budget}
+		next.ServeHTTP(dw, r.WithContext(ctx))
+		if !dw.wroteHeader && ctx.Err() == context.DeadlineExceeded {
+			dw.WriteHeader(http.StatusGatewayTimeout)
+		}
+		if dw.exceeded {
+			requestDeadlines.inc("exhausted")
+		} else {
+			requestDeadlines.inc("honored")
+		}
+	})
+}
+
+// deadlineExceeded answers a request whose caller's deadline passed.
+func deadlineExceeded(w http.ResponseWriter, budget time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     "deadline_exceeded",
+		"message":   "The request deadline passed before it was answered",
+		"budget_ms": budget.Milliseconds(),
+	})
+}
+
+// deadlineWriter replaces the answer of a handler that only got to it after
+// the deadline, which is whatever its cancelled work failed with, by the
+// 504. Answers started in time are passed on.
+type deadlineWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	budget      time.Duration
+	wroteHeader bool
+	exceeded    bool
+}
+
+func (w *deadlineWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.ctx.Err() == context.DeadlineExceeded {
+		w.exceeded = true
+		h := w.Header()
+		for name := range h {
+			if name != "X-Request-Id" && name != "X-Features" {
+				h.Del(name)
+			}
+		}
+		deadlineExceeded(w.ResponseWriter, w.budget)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.exceeded {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *deadlineWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.exceeded {
+		f.Flush()
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+// duplicateError is returned by insertMessage when the same key already
+// posted the same body within the dedupe window.
+type duplicateError struct {
+	id        string
+	timestamp string
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("Message was already sent at %s!", e.timestamp)
+}
+
+// contentHash identifies a message body posted to a channel with an access
+// key. The key only goes into the hash, so the column does not leak it.
+func contentHash(channel, key, body string) string {
+	sum := sha256.Sum256([]byte(channel + "\x00" + key + "\x00" + body))
+	return hex.EncodeToString(sum[:])
+}
+
+// findDuplicate looks for a message with the same content hash inside the
+// dedupe window. The locking read takes next-key locks on the
+// (content_hash, timestamp) index, so concurrent double-submits of one body
+// are serialized instead of both getting in.
+func findDuplicate(tx *sql.Tx, hash string) (*duplicateError, error) {
+	if dedupe_window <= 0 {
+		return nil, nil
+	}
+	seconds := int64(math.Ceil(dedupe_window.Seconds()))
+	var dup duplicateError
+	err := tx.QueryRow("SELECT id, timestamp FROM messages WHERE content_hash = ? AND timestamp >= NOW() - INTERVAL ? SECOND ORDER BY timestamp DESC LIMIT 1 FOR UPDATE", hash, seconds).Scan(&dup.id, &dup.timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dup, nil
+}
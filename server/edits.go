@@ -0,0 +1,220 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// errPreconditionFailed is returned by changes to a message that was
+// modified since the client last saw it.
+var errPreconditionFailed = errors.New("Message was modified in the meantime!")
+
+// preconditions are the If-Match and If-Unmodified-Since headers of a
+// request that changes a message. Every change bumps the version of a
+// message, which is also its ETag, and sets updated_at, its Last-Modified.
+type preconditions struct {
+	match           []string
+	unmodifiedSince time.Time
+}
+
+func parsePreconditions(r *http.Request) (*preconditions, error) {
+	var p preconditions
+	if h := r.Header.Get("If-Match"); h != "" {
+		// If-Match compares strongly, the W/ of a weak tag is kept so it
+		// never matches.
+		for _, tag := range strings.Split(h, ",") {
+			p.match = append(p.match, strings.TrimSpace(tag))
+		}
+	}
+	if h := r.Header.Get("If-Unmodified-Since"); h != "" {
+		t, err := http.ParseTime(h)
+		if err != nil {
+			return nil, errors.New("If-Unmodified-Since is not a valid HTTP date!")
+		}
+		p.unmodifiedSince = t
+	}
+	if p.match == nil && p.unmodifiedSince.IsZero() {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// hold reports whether the preconditions hold for a message last modified at
+// modified with the given version. If-Unmodified-Since is ignored when
+// If-Match is present.
+func (p *preconditions) hold(modified time.Time, version int) bool {
+	if p.match != nil {
+		etag := messageETag(version)
+		for _, tag := range p.match {
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	return !modified.Truncate(time.Second).After(p.unmodifiedSince)
+}
+
+func messageETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// lockMessage locks a message of a channel for a change and checks the
+// preconditions against it, returning whether the message is held for
+// review. An empty channel matches any channel.
+func lockMessage(tx *sql.Tx, channel string, messageID int64, pre *preconditions) (bool, error) {
+	var modified int64
+	var version int
+	var flagged bool
+	err := tx.QueryRow("SELECT UNIX_TIMESTAMP(COALESCE(updated_at, timestamp)), version, flagged FROM messages WHERE id = ? AND (channel = ? OR ? = '') FOR UPDATE", messageID, channel, channel).Scan(&modified, &version, &flagged)
+	if err != nil {
+		return false, err
+	}
+	if pre != nil && !pre.hold(time.Unix(modified, 0), version) {
+		return flagged, errPreconditionFailed
+	}
+	return flagged, nil
+}
+
+// setVersionHeaders sends the ETag and Last-Modified of a message.
+func setVersionHeaders(rw http.ResponseWriter, modified int64, version int) {
+	rw.Header().Set("ETag", messageETag(version))
+	rw.Header().Set("Last-Modified", time.Unix(modified, 0).UTC().Format(http.TimeFormat))
+}
+
+// updateMessage handles PUT /messages/{id}, replacing the body of a message.
+// The new body is redacted and moderated like a new message.
+func updateMessage(messageID int64) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !authorized(rw, r) {
+			return
+		}
+		pre, err := parsePreconditions(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err := decodeMessage(requestCodec(r), r.Body)
+		if err != nil {
+			bodyError(rw, err)
+			return
+		}
+		if len(msg.Message) == 0 {
+			http.Error(rw, "Message is required!", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(msg.Message) > maxMessageLength {
+			http.Error(rw, fmt.Sprintf("Message must be at most %d characters!", maxMessageLength), http.StatusBadRequest)
+			return
+		}
+		msg.Tags, err = normalizeTags(msg.Tags)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var redacted map[string]int
+		msg.Message, redacted = redactPII(msg.Message)
+		setRedactedHeader(rw, redacted)
+		var rejected *rejectedError
+		if err := moderateMessage(r.Context(), &msg); errors.As(err, &rejected) {
+			http.Error(rw, rejected.Error(), http.StatusUnprocessableEntity)
+			return
+		} else if err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to moderate message", http.StatusServiceUnavailable)
+			return
+		}
+		db, err := initDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		var modified int64
+		var version int
+		err = withRetry(r.Context(), "update_message", func() error {
+			var err error
+			modified, version, err = editMessage(db, channelOf(r).name, messageID, msg, pre)
+			return err
+		})
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(rw, "Message not found", http.StatusNotFound)
+			return
+		case err == errPreconditionFailed:
+			http.Error(rw, err.Error(), http.StatusPreconditionFailed)
+			return
+		case err != nil:
+			log.Println(err)
+			storeError(rw, err, "Unable to update message")
+			return
+		}
+		setVersionHeaders(rw, modified, version)
+		if msg.Flagged {
+			rw.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(rw, msg.Message, "is held for review.")
+			return
+		}
+		fmt.Fprintln(rw, msg.Message, "is updated.")
+	})
+}
+
+// editMessage stores the new body and tags of a message and returns its new
+// modification time and version. Messages held for review cannot be edited,
+// an edit that passes moderation would publish them without a review.
+func editMessage(db *sql.DB, channel string, messageID int64, msg messageType, pre *preconditions) (int64, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	flagged, err := lockMessage(tx, channel, messageID, pre)
+	if err == nil && flagged {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var reason sql.NullString
+	if msg.Flagged {
+		reason = sql.NullString{String: msg.FlagReason, Valid: true}
+	}
+	body, keyID, err := sealBody(msg.Message)
+	if err != nil {
+		return 0, 0, err
+	}
+	// An edit held for review takes the message out of the listings, which
+	// is recorded while it is still visible.
+	if msg.Flagged {
+		if err := recordEvent(tx, eventDeleted, messageID); err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := tx.Exec("UPDATE messages SET message = ?, key_id = ?, flagged = ?, flag_reason = ?, version = version + 1, updated_at = NOW() WHERE id = ?", body, keyID, msg.Flagged, reason, messageID); err != nil {
+		return 0, 0, err
+	}
+	// Like the body, the tags are replaced by those of the edit.
+	if _, err := tx.Exec("DELETE FROM message_tags WHERE message_id = ?", messageID); err != nil {
+		return 0, 0, err
+	}
+	if err := tagMessage(tx, messageID, msg.Tags); err != nil {
+		return 0, 0, err
+	}
+	if !msg.Flagged {
+		if err := recordEvent(tx, eventUpdated, messageID); err != nil {
+			return 0, 0, err
+		}
+	}
+	var modified int64
+	var version int
+	if err := tx.QueryRow("SELECT UNIX_TIMESTAMP(updated_at), version FROM messages WHERE id = ?", messageID).Scan(&modified, &version); err != nil {
+		return 0, 0, err
+	}
+	return modified, version, commit(tx)
+}
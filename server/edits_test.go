@@ -0,0 +1,83 @@
+package server
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestEditMessageEvents(t *testing.T) {
+	db := setupStore(t, "-events_url", "nats://127.0.0.1:4222")
+	tests := []struct {
+		name    string
+		flagged bool
+		want    string
+	}{
+		{"published edit", false, eventUpdated},
+		{"edit held for review", true, eventDeleted},
+	}
+	for _, tt := range tests {
+		res, err := db.Exec("INSERT INTO messages(message, channel) VALUES ('before', 'default')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		msg := messageType{Message: "after", Flagged: tt.flagged, FlagReason: "spam"}
+		if _, _, err := editMessage(db, defaultChannel, id, msg, nil); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var kinds []string
+		rows, err := db.Query("SELECT kind FROM message_events WHERE message_id = ? ORDER BY id", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var kind string
+			if err := rows.Scan(&kind); err != nil {
+				t.Fatal(err)
+			}
+			kinds = append(kinds, kind)
+		}
+		rows.Close()
+		if len(kinds) != 1 || kinds[0] != tt.want {
+			t.Errorf("%s: events = %v, want [%s]", tt.name, kinds, tt.want)
+		}
+	}
+}
+
+func TestEditMessageTags(t *testing.T) {
+	db := setupStore(t, "-events_url", "nats://127.0.0.1:4222")
+	res, err := db.Exec("INSERT INTO messages(message, channel) VALUES ('before', 'default')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tagMessage(tx, id, []string{"ops", "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]string{{"new", "ops"}, nil} {
+		if _, _, err := editMessage(db, defaultChannel, id, messageType{Message: "after", Tags: want}, nil); err != nil {
+			t.Fatal(err)
+		}
+		var tags, event sql.NullString
+		if err := db.QueryRow("SELECT GROUP_CONCAT(t.name ORDER BY t.name) FROM message_tags mt JOIN tags t ON t.id = mt.tag_id WHERE mt.message_id = ?", id).Scan(&tags); err != nil {
+			t.Fatal(err)
+		}
+		if got := splitTags(tags); !reflect.DeepEqual(got, want) {
+			t.Errorf("tags = %v, want %v", got, want)
+		}
+		if err := db.QueryRow("SELECT tags FROM message_events WHERE message_id = ? ORDER BY id DESC LIMIT 1", id).Scan(&event); err != nil {
+			t.Fatal(err)
+		}
+		if got := splitTags(event); !reflect.DeepEqual(got, want) {
+			t.Errorf("event tags = %v, want %v", got, want)
+		}
+	}
+}
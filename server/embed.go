@@ -0,0 +1,148 @@
+package server
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Config configures a Server embedded in another program. Options without
+// a field are set by their command line flag in Flags, the same flags the
+// binary takes.
+//
+// The configuration is kept in package state, so a process runs one Server.
+type Config struct {
+	// MySQLDSN is the database, -mysql_dsn.
+	MySQLDSN string
+	// AccessKey is the key messages are posted to the default channel with,
+	// -access_key.
+	AccessKey string
+	// AdminKey enables the /admin endpoints, -admin_key.
+	AdminKey string
+	// BasePath is the path the handler is mounted at in the program's mux,
+	// like /messages-api, -base_path. Links in responses include it.
+	BasePath string
+	// Logger gets the log of the server, which is discarded when nil.
+	Logger *log.Logger
+	// Flags are further options, like []string{"-page_size=50"}.
+	Flags []string
+}
+
+// A Middleware wraps a handler.
+type Middleware func(http.Handler) http.Handler
+
+// New configures the server for an embedding program. Handler serves the
+// API, StartWorkers starts the background work the standalone server does,
+// Shutdown stops it. The database is connected to lazily, on first use.
+func New(cfg Config) (*Server, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse(cfg.Flags); err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]string{
+		"mysql_dsn":  cfg.MySQLDSN,
+		"access_key": cfg.AccessKey,
+		"admin_key":  cfg.AdminKey,
+		"base_path":  cfg.BasePath,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	if err := configure(); err != nil {
+		return nil, err
+	}
+	return newServer(logger), nil
+}
+
+// Handler serves the API below -base_path, wrapped in middleware with the
+// first outermost. Without middleware the routes are served bare, Tracing,
+// Featuring, Logging, Capturing, Localizing, Deadlines, Chaos and Limiting
+// are what the standalone server uses.
+func (s *Server) Handler(middleware ...Middleware) http.Handler {
+	var h http.Handler = s.routes
+	if base_path != "" {
+		h = stripBasePath(h)
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// stripBasePath hands requests below -base_path to h without it and
+// answers everything else with 404.
+func stripBasePath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, base_path)
+		if len(rest) == len(r.URL.Path) || (rest != "" && rest[0] != '/') {
+			http.NotFound(rw, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path, u.RawPath = rest, ""
+		r2.URL = &u
+		h.ServeHTTP(rw, r2)
+	})
+}
+
+// Tracing gives every request an X-Request-Id, keeping the one sent.
+func Tracing() Middleware {
+	return tracing(nextRequestID)
+}
+
+// Featuring decides the feature flags of every request, by its X-Client-Id
+// or else its X-Request-Id, so it goes after Tracing.
+func Featuring() Middleware {
+	return featuring
+}
+
+// Logging writes an access log line for every request.
+func Logging(logger *log.Logger) Middleware {
+	return logging(logger)
+}
+
+// Capturing logs the bodies of failing requests while -capture_bodies or
+// /admin/capture has it enabled.
+func Capturing(logger *log.Logger) Middleware {
+	return capturing(logger)
+}
+
+// Localizing translates plain text answers to the language the client
+// prefers, when there is a catalog for it.
+func Localizing() Middleware {
+	return localizing
+}
+
+// Deadlines ends the requests of callers from -deadline_trusted at the
+// deadline they sent, answering 504 when it passes first.
+func Deadlines() Middleware {
+	return deadlines
+}
+
+// Chaos injects the faults set at /admin/chaos when -chaos is on, and does
+// nothing otherwise.
+func Chaos() Middleware {
+	return injectFaults(chaos)
+}
+
+// Limiting bounds the requests served at once by -max_concurrent,
+// -max_queued and -queue_timeout. It is meant to be used once.
+func Limiting() Middleware {
+	return limiting(max_concurrent, max_queued, queue_timeout)
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With -encryption_keys, message bodies are encrypted with AES-GCM before
+// they are stored and decrypted when they are read. Each row names the key
+// it was encrypted with in key_id, NULL for plaintext, so keys can be
+// rotated: a new -encryption_key_id is used for new writes while the old
+// keys stay configured until /admin/reencrypt has moved every row over.
+
+type keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+var currentKeyring atomic.Value
+
+// parseKeyring parses -encryption_keys, id=key pairs separated by commas or
+// newlines with base64 encoded AES keys of 16, 24 or 32 bytes.
+func parseKeyring(spec, active string) (*keyring, error) {
+	kr := &keyring{keys: map[string]cipher.AEAD{}, active: active}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.IndexByte(entry, '=')
+		if i < 1 || i > 32 {
+			return nil, fmt.Errorf("encryption key %d needs an id of at most 32 characters, use id=key", len(kr.keys)+1)
+		}
+		id := entry[:i]
+		raw, err := base64.StdEncoding.DecodeString(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not valid base64", id)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %v", id, err)
+		}
+		kr.keys[id], _ = cipher.NewGCM(block)
+	}
+	if active == "" && len(kr.keys) == 1 {
+		for id := range kr.keys {
+			kr.active = id
+		}
+	}
+	if kr.active != "" && kr.keys[kr.active] == nil {
+		return nil, fmt.Errorf("-encryption_key_id %s is not one of -encryption_keys", kr.active)
+	}
+	return kr, nil
+}
+
+func loadKeyring() error {
+	kr, err := parseKeyring(currentSecret("encryption_keys"), encryption_key_id)
+	if err != nil {
+		return err
+	}
+	currentKeyring.Store(kr)
+	return nil
+}
+
+func keys() *keyring {
+	kr, _ := currentKeyring.Load().(*keyring)
+	if kr == nil {
+		return &keyring{}
+	}
+	return kr
+}
+
+// sealBody encrypts a message body with the active key. Without one the
+// body is stored as it is.
+func sealBody(body string) (string, sql.NullString, error) {
+	kr := keys()
+	if kr.active == "" {
+		return body, sql.NullString{}, nil
+	}
+	aead := kr.keys[kr.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", sql.NullString{}, err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(body), []byte(kr.active))
+	return base64.StdEncoding.EncodeToString(sealed), sql.NullString{String: kr.active, Valid: true}, nil
+}
+
+// openBody decrypts a stored message body with the key it names.
+func openBody(stored string, keyID sql.NullString) (string, error) {
+	if !keyID.Valid {
+		return stored, nil
+	}
+	aead := keys().keys[keyID.String]
+	if aead == nil {
+		return "", fmt.Errorf("message is encrypted with unknown key %s", keyID.String)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted message is malformed")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(keyID.String))
+	if err != nil {
+		return "", fmt.Errorf("message cannot be decrypted with key %s: %v", keyID.String, err)
+	}
+	return string(plain), nil
+}
+
+// reencryption is the state of the job started at /admin/reencrypt.
+type reencryption struct {
+	mu       sync.Mutex
+	Running  bool   `json:"running"`
+	KeyID    string `json:"key_id"`
+	Done     int    `json:"done"`
+	Error    string `json:"error,omitempty"`
+	Started  string `json:"started,omitempty"`
+	Finished string `json:"finished,omitempty"`
+}
+
+var reencrypting reencryption
+
+// reencryptTables are the tables holding message bodies. The outbox of
+// -events_url copies them, its deleted events have none.
+var reencryptTables = []string{"messages", "messages_archive", "message_events"}
+
+// reencryptBatch rewrites up to archive_batch bodies of table not encrypted
+// with the active key and returns how many it rewrote.
+func reencryptBatch(ctx context.Context, db *sql.DB, table string) (int, error) {
+	kr := keys()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var rows *sql.Rows
+	if kr.active == "" {
+		rows, err = tx.Query("SELECT id, message, key_id FROM "+table+" WHERE key_id IS NOT NULL AND message IS NOT NULL ORDER BY id LIMIT ? FOR UPDATE", archive_batch)
+	} else {
+		rows, err = tx.Query("SELECT id, message, key_id FROM "+table+" WHERE (key_id IS NULL OR key_id <> ?) AND message IS NOT NULL ORDER BY id LIMIT ? FOR UPDATE", kr.active, archive_batch)
+	}
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id      int64
+		message string
+		keyID   sql.NullString
+	}
+	var batch []row
+	for rows.Next() {
+		var rw row
+		if err := rows.Scan(&rw.id, &rw.message, &rw.keyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, rw)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, rw := range batch {
+		plain, err := openBody(rw.message, rw.keyID)
+		if err != nil {
+			return 0, fmt.Errorf("%s %d: %v", table, rw.id, err)
+		}
+		stored, keyID, err := sealBody(plain)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE "+table+" SET message = ?, key_id = ? WHERE id = ?", stored, keyID, rw.id); err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), commit(tx)
+}
+
+// reencryptAll rewrites the bodies of every table in batches until none is
+// left or ctx, the background context of the server, is cancelled.
+func reencryptAll(ctx context.Context, logger *log.Logger) {
+	defer func() {
+		reencrypting.mu.Lock()
+		reencrypting.Running = false
+		reencrypting.Finished = time.Now().UTC().Format(time.RFC3339)
+		reencrypting.mu.Unlock()
+	}()
+	fail := func(err error) {
+		logger.Println("Re-encryption failed:", err)
+		reencrypting.mu.Lock()
+		reencrypting.Error = err.Error()
+		reencrypting.mu.Unlock()
+	}
+	db, err := initDB()
+	if err != nil {
+		fail(err)
+		return
+	}
+	for _, table := range reencryptTables {
+		for {
+			var n int
+			err := withRetry(ctx, "reencrypt", func() (err error) {
+				n, err = reencryptBatch(ctx, db, table)
+				return err
+			})
+			if err != nil {
+				fail(err)
+				return
+			}
+			if n == 0 {
+				break
+			}
+			reencrypting.mu.Lock()
+			reencrypting.Done += n
+			reencrypting.mu.Unlock()
+		}
+	}
+	logger.Printf("Re-encryption finished, %d messages rewritten\n", reencrypting.Done)
+}
+
+// reencrypt serves /admin/reencrypt: GET reports on the last job, POST
+// starts rewriting every body not encrypted with the active key. Without an
+// active key the bodies are decrypted.
+func reencrypt(ctx context.Context, logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		authorized := adminAuthorized
+		if r.Method == "POST" {
+			authorized = adminSigned
+		}
+		if !authorized(rw, r) {
+			return
+		}
+		reencrypting.mu.Lock()
+		defer reencrypting.mu.Unlock()
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if reencrypting.Running {
+				http.Error(rw, "Re-encryption is already running!", http.StatusConflict)
+				return
+			}
+			reencrypting.Running, reencrypting.KeyID, reencrypting.Done = true, keys().active, 0
+			reencrypting.Error, reencrypting.Finished = "", ""
+			reencrypting.Started = time.Now().UTC().Format(time.RFC3339)
+			if !goBackground(ctx, func(ctx context.Context) { reencryptAll(ctx, logger) }) {
+				reencrypting.Running = false
+				http.Error(rw, "Server is shutting down!", http.StatusServiceUnavailable)
+				return
+			}
+			rw.WriteHeader(http.StatusAccepted)
+		default:
+			rw.Header().Set("Allow", "GET, POST")
+			http.Error(rw, "Only GET and POST methods are allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(&reencrypting)
+	})
+}
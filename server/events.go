@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// With -events_url every message that appears, changes or disappears from
+// the listings is published to NATS as a JSON event. Events are written to
+// the message_events outbox in the transaction of the change and published
+// from there in batches, so an event is never lost when NATS or the server
+// is down; it may be published twice, consumers tell them apart by id.
+
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+)
+
+var (
+	eventsPublished      = newCounter("events_published_total", "Message events published, by kind.", "kind")
+	eventsPublishFailure = newCounter("events_publish_failures_total", "Batches of message events that could not be published.")
+	eventsDropped        = newCounter("events_dropped_total", "Message events dropped from the outbox because their body could not be decrypted.")
+)
+
+// A messageEvent is what is published to <-events_subject>.<channel>.<kind>.
+type messageEvent struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Channel   string    `json:"channel"`
+	MessageID string    `json:"message_id"`
+	Message   string    `json:"message,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// recordEvent adds an event about a message to the outbox in tx. Created
+// and updated events copy the body as stored, it is decrypted when the event
+// is published; deleted ones must be recorded before the message is
+// deleted. Messages held for review are not visible, they get no events.
+func recordEvent(tx *sql.Tx, kind string, messageID int64) error {
+	if events_url == "" {
+		return nil
+	}
+	if kind == eventDeleted {
+		_, err := tx.Exec("INSERT INTO message_events(kind, channel, message_id) SELECT ?, channel, id FROM messages WHERE id = ? AND flagged = 0", kind, messageID)
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO message_events(kind, channel, message_id, message, key_id, tags) SELECT ?, m.channel, m.id, m.message, m.key_id, GROUP_CONCAT(t.name ORDER BY t.name) FROM messages m LEFT JOIN message_tags mt ON mt.message_id = m.id LEFT JOIN tags t ON t.id = mt.tag_id WHERE m.id = ? AND m.flagged = 0 GROUP BY m.id, m.channel, m.message, m.key_id", kind, messageID)
+	return err
+}
+
+// eventPublisher publishes the outbox until ctx is cancelled. It backs off
+// while NATS or the database fail, up to a minute between attempts.
+func eventPublisher(ctx context.Context, logger *log.Logger) {
+	var conn *natsConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	backoff := events_interval
+	for {
+		n, err := publishEvents(ctx, logger, &conn)
+		wait := events_interval
+		switch {
+		case err != nil && ctx.Err() == nil:
+			eventsPublishFailure.inc()
+			logger.Println("Could not publish message events:", err)
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			wait = backoff
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+		case n == events_batch:
+			// There is more to publish right away.
+			wait = 0
+			backoff = events_interval
+		default:
+			backoff = events_interval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// publishEvents publishes the oldest batch of the outbox and then deletes
+// it, returning how many events it loaded. Nothing is locked while it is
+// published, NATS being slow must not hold up the writes adding to the
+// outbox, so replicas publishing at the same time may both publish a batch.
+// An event whose body cannot be decrypted, its key was removed, is logged and
+// dropped so it does not hold up the rest of the outbox.
+func publishEvents(ctx context.Context, logger *log.Logger, conn **natsConn) (int, error) {
+	db, err := initDB()
+	if err != nil {
+		return 0, err
+	}
+	var events []messageEvent
+	var ids []interface{}
+	err = timed(ctx, "load_events", func() error {
+		rows, err := db.QueryContext(ctx, "SELECT id, kind, channel, message_id, message, key_id, tags, created_at FROM message_events ORDER BY id LIMIT ?", events_batch)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var e messageEvent
+			var messageID int64
+			var body, keyID, tags sql.NullString
+			if err := rows.Scan(&e.ID, &e.Kind, &e.Channel, &messageID, &body, &keyID, &tags, &e.At); err != nil {
+				return err
+			}
+			ids = append(ids, e.ID)
+			e.MessageID = formatID(messageID)
+			if body.Valid {
+				if e.Message, err = openBody(body.String, keyID); err != nil {
+					eventsDropped.inc()
+					logger.Printf("Dropping message event %d: %v\n", e.ID, err)
+					continue
+				}
+			}
+			e.Tags = splitTags(tags)
+			events = append(events, e)
+		}
+		return rows.Err()
+	})
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	if len(events) > 0 {
+		if *conn == nil {
+			if *conn, err = dialNATS(ctx, currentSecret("events_url")); err != nil {
+				return 0, err
+			}
+		}
+		for _, e := range events {
+			payload, err := json.Marshal(e)
+			if err != nil {
+				return 0, err
+			}
+			(*conn).publish(events_subject+"."+e.Channel+"."+e.Kind, payload)
+		}
+		if err := (*conn).flush(events_timeout); err != nil {
+			return 0, err
+		}
+	}
+
+	// By id, an event of a transaction that committed late may have a
+	// lower one without being in the batch.
+	if _, err := db.ExecContext(ctx, "DELETE FROM message_events WHERE id IN ("+placeholders(len(ids))+")", ids...); err != nil {
+		return 0, err
+	}
+	for _, e := range events {
+		eventsPublished.inc(e.Kind)
+	}
+	return len(ids), nil
+}
+
+// natsConn is a connection speaking the NATS client protocol, enough of it
+// to publish.
+type natsConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// dialNATS connects to a nats://[user:password@]host:port URL.
+func dialNATS(ctx context.Context, rawURL string) (*natsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: events_timeout}
+	nc, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	c.SetDeadline(time.Now().Add(events_timeout))
+	line, err := c.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		nc.Close()
+		return nil, fmt.Errorf("nats: %s did not greet with INFO: %v", u.Host, err)
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "simple-http-server", "lang": "go", "protocol": 0}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		opts["pass"], _ = u.User.Password()
+	}
+	connect, _ := json.Marshal(opts)
+	fmt.Fprintf(c.w, "CONNECT %s\r\n", connect)
+	if err := c.flush(events_timeout); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *natsConn) publish(subject string, payload []byte) {
+	fmt.Fprintf(c.w, "PUB %s %d\r\n", subject, len(payload))
+	c.w.Write(payload)
+	c.w.WriteString("\r\n")
+}
+
+// flush sends what was published and waits for the server to answer a
+// PING, which it does after it has processed everything sent before.
+func (c *natsConn) flush(timeout time.Duration) error {
+	c.w.WriteString("PING\r\n")
+	c.SetDeadline(time.Now().Add(timeout))
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			c.w.WriteString("PONG\r\n")
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
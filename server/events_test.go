@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+// natsStub accepts NATS connections, answers their PINGs and sends the
+// subjects published on ch.
+func natsStub(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan string, 100)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte("INFO {}\r\n"))
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch f := strings.Fields(line); {
+					case len(f) == 3 && f[0] == "PUB":
+						r.ReadString('\n')
+						ch <- f[1]
+					case len(f) > 0 && f[0] == "PING":
+						c.Write([]byte("PONG\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return "nats://" + l.Addr().String(), ch
+}
+
+func TestPublishEventsDropsUndecryptable(t *testing.T) {
+	addr, published := natsStub(t)
+	db := setupStore(t, "-events_url", addr, "-encryption_keys", "k1=MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	body, keyID, err := sealBody("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(body string, keyID sql.NullString) {
+		if _, err := db.Exec("INSERT INTO message_events(kind, channel, message_id, message, key_id) VALUES ('created', 'default', 1, ?, ?)", body, keyID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(body, keyID)
+	insert(body, sql.NullString{String: "gone", Valid: true})
+	insert(body, keyID)
+
+	var conn *natsConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	n, err := publishEvents(context.Background(), log.New(ioutil.Discard, "", 0), &conn)
+	if err != nil || n != 3 {
+		t.Fatalf("publishEvents = %d, %v, want 3", n, err)
+	}
+	if len(published) != 2 {
+		t.Errorf("published %d events, want 2", len(published))
+	}
+	var left int
+	if err := db.QueryRow("SELECT COUNT(*) FROM message_events").Scan(&left); err != nil || left != 0 {
+		t.Errorf("%d events left in the outbox, want 0 (%v)", left, err)
+	}
+}
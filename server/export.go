@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// exportRoute is the key of /messages/export in the timeout table. Exports
+// stream, so it has no timeout by default.
+const exportRoute = "/messages/export"
+
+// exportPageSize is how many messages an export reads at a time.
+const exportPageSize = 500
+
+// exportMessages serves /messages/export: every message of the channel as
+// NDJSON, oldest first. It reads in a single REPEATABLE READ transaction, so
+// the export is a snapshot of the channel when it started however long it
+// takes to download; messages added, edited or deleted meanwhile are left
+// as they were.
+func exportMessages() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			http.Error(rw, "Only GET method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		zone, err := displayZone(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		tx, err := db.BeginTx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get messages from db")
+			return
+		}
+		defer tx.Rollback()
+
+		enc := json.NewEncoder(rw)
+		flusher, _ := rw.(http.Flusher)
+		var afterID int64
+		for first := true; ; first = false {
+			batch, err := exportPage(r.Context(), tx, channelOf(r), afterID)
+			if err != nil {
+				log.Println(err)
+				if first {
+					storeError(rw, err, "Unable to get messages from db")
+					return
+				}
+				// The export is cut short, the client must not take what
+				// it got for all of it.
+				panic(http.ErrAbortHandler)
+			}
+			if first {
+				rw.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			inZone(batch, zone)
+			for _, msg := range batch {
+				if err := enc.Encode(msg); err != nil {
+					return
+				}
+			}
+			if len(batch) < exportPageSize {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			afterID, _ = parseID(batch[len(batch)-1].Id)
+		}
+	})
+}
+
+func exportPage(ctx context.Context, tx *sql.Tx, c *channel, afterID int64) ([]messageType, error) {
+	var rows *sql.Rows
+	err := timed(ctx, "export_messages", func() (err error) {
+		rows, err = tx.Query(selectMessages+" WHERE m.channel = ? AND m.flagged = 0 AND m.id > ?"+groupMessages+" ORDER BY m.id LIMIT ?", c.name, afterID, exportPageSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []messageType
+	for rows.Next() {
+		var msg messageType
+		var tags, keyID sql.NullString
+		if err := rows.Scan(&msg.Id, &msg.Message, &msg.Timestamp, &msg.Modified, &msg.Version, &tags, &keyID); err != nil {
+			return nil, err
+		}
+		if msg.Message, err = openBody(msg.Message, keyID); err != nil {
+			return nil, err
+		}
+		msg.Tags = splitTags(tags)
+		out = append(out, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return out, loadDetails(ctx, tx, out, c.prefix(), nil)
+}
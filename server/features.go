@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Feature flags roll out new behavior gradually. Each known feature is on
+// for a percentage of the callers, set by -features and changed at
+// /admin/features. A caller is in it or not by the hash of the X-Client-Id
+// it sends, so it gets the same answers from one request to the next, or of
+// the X-Request-Id of every request without one. A client can also
+// ask for features in the X-Features request header, which turns them on for
+// it whatever their rollout. The features a request is in are decided once,
+// by the Featuring middleware or when first asked for, and sent in
+// X-Features.
+
+// knownFeatures are the features that can be rolled out, with what they do.
+var knownFeatures = map[string]string{
+	"envelope": `JSON listings of /messages answer {"messages": [...], "next": url} instead of a bare list`,
+}
+
+// featureRollout holds the map[string]int of the percentage each feature is
+// on for, features left out are off.
+var featureRollout atomic.Value
+
+func init() {
+	newGaugeFunc("feature_rollout_percent", "Percentage of callers a feature flag is on for, by feature.", []string{"feature"}, func() []sample {
+		rollout := rollouts()
+		out := make([]sample, 0, len(knownFeatures))
+		for name := range knownFeatures {
+			out = append(out, sample{labels: []string{name}, value: float64(rollout[name])})
+		}
+		return out
+	})
+}
+
+func rollouts() map[string]int {
+	rollout, _ := featureRollout.Load().(map[string]int)
+	return rollout
+}
+
+// parseFeatures parses -features, comma separated name=percent pairs, a
+// name alone being on for every request.
+func parseFeatures(spec string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range splitList(spec) {
+		name, percent := entry, 100
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			name = strings.TrimSpace(entry[:i])
+			var err error
+			if percent, err = strconv.Atoi(strings.TrimSpace(entry[i+1:])); err != nil {
+				return nil, fmt.Errorf("Percentage of feature %q is not a number", name)
+			}
+		}
+		if err := validateRollout(name, percent); err != nil {
+			return nil, err
+		}
+		out[name] = percent
+	}
+	return out, nil
+}
+
+func validateRollout(name string, percent int) error {
+	if _, ok := knownFeatures[name]; !ok {
+		return fmt.Errorf("Unknown feature %q!", name)
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("Percentage of feature %q must be between 0 and 100!", name)
+	}
+	return nil
+}
+
+// inRollout reports whether the caller is among the percent of callers
+// feature is on for. Every feature hashes the caller with its name, so the
+// callers of different rollouts are not the same ones.
+func inRollout(feature, caller string, percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(feature + "\n" + caller))
+	return int(h.Sum32()%100) < percent
+}
+
+// rolloutCaller is who r is decided for: the client it names in X-Client-Id
+// or, without one, the request itself.
+func rolloutCaller(r *http.Request) string {
+	if id := r.Header.Get("X-Client-Id"); id != "" {
+		return id
+	}
+	return requestIDOf(r.Context())
+}
+
+// enabledFeatures decides the features r is in: those its caller is in the
+// rollout of and the known ones it asks for.
+func enabledFeatures(r *http.Request) map[string]bool {
+	caller := rolloutCaller(r)
+	on := map[string]bool{}
+	for name, percent := range rollouts() {
+		if inRollout(name, caller, percent) {
+			on[name] = true
+		}
+	}
+	for _, name := range splitList(r.Header.Get("X-Features")) {
+		if _, ok := knownFeatures[name]; ok {
+			on[name] = true
+		}
+	}
+	return on
+}
+
+// featuring decides the features of every request before it is served, so
+// changing a rollout does not switch them in the middle of one.
+func featuring(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		on := enabledFeatures(r)
+		if len(on) > 0 {
+			names := make([]string, 0, len(on))
+			for name := range on {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			w.Header().Set("X-Features", strings.Join(names, ","))
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), featuresKey, on)))
+	})
+}
+
+// featureOn reports whether feature is on for r. Without the Featuring
+// middleware it is decided on every call.
+func featureOn(r *http.Request, feature string) bool {
+	if on, ok := r.Context().Value(featuresKey).(map[string]bool); ok {
+		return on[feature]
+	}
+	return enabledFeatures(r)[feature]
+}
+
+// featuresAdmin serves /admin/features: GET lists the known features and
+// their rollouts, POST sets the percentages in the body, leaving the other
+// features as they are, and DELETE goes back to -features.
+func featuresAdmin() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(rw, r) {
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Features map[string]int `json:"features"`
+			}
+			if err := decodeJSON(r.Body, &req); err != nil {
+				bodyError(rw, err)
+				return
+			}
+			rollout := map[string]int{}
+			for name, percent := range rollouts() {
+				rollout[name] = percent
+			}
+			for name, percent := range req.Features {
+				if err := validateRollout(name, percent); err != nil {
+					http.Error(rw, err.Error(), http.StatusBadRequest)
+					return
+				}
+				rollout[name] = percent
+			}
+			featureRollout.Store(rollout)
+			log.Println("Feature rollouts set:", req.Features)
+		case "DELETE":
+			rollout, _ := parseFeatures(features)
+			featureRollout.Store(rollout)
+			log.Println("Feature rollouts reset to -features")
+		default:
+			rw.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(rw, "Only GET, POST and DELETE methods are allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		type feature struct {
+			Description string `json:"description"`
+			Percent     int    `json:"percent"`
+		}
+		rollout := rollouts()
+		out := map[string]feature{}
+		for name, description := range knownFeatures {
+			out[name] = feature{Description: description, Percent: rollout[name]}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{"features": out})
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInRolloutSplit(t *testing.T) {
+	const callers = 10000
+	for _, percent := range []int{0, 1, 10, 25, 50, 90, 100} {
+		for _, caller := range []func(i int) string{
+			func(i int) string { return fmt.Sprintf("client-%d", i) },
+			func(i int) string {
+				return strconv.FormatInt(time.Date(2026, 10, 14, 7, 0, 0, i*1337, time.UTC).UnixNano(), 10)
+			},
+		} {
+			in := 0
+			for i := 0; i < callers; i++ {
+				if inRollout("envelope", caller(i), percent) {
+					in++
+				}
+			}
+			if got := float64(in) * 100 / callers; got < float64(percent)-2 || got > float64(percent)+2 {
+				t.Errorf("%d%% rollout: %.1f%% of %s... are in", percent, got, caller(0))
+			}
+		}
+	}
+}
+
+func TestEnabledFeaturesCaller(t *testing.T) {
+	featureRollout.Store(map[string]int{"envelope": 50})
+	defer featureRollout.Store(map[string]int{})
+	request := func(clientID, requestID string) map[string]bool {
+		r := httptest.NewRequest("GET", "/messages", nil)
+		if clientID != "" {
+			r.Header.Set("X-Client-Id", clientID)
+		}
+		return enabledFeatures(r.WithContext(context.WithValue(r.Context(), requestIDKey, requestID)))
+	}
+	// A client gets the same answer on every request.
+	for i := 0; i < 100; i++ {
+		want := request(fmt.Sprintf("client-%d", i), "1")["envelope"]
+		for j := 2; j < 10; j++ {
+			if got := request(fmt.Sprintf("client-%d", i), strconv.Itoa(j))["envelope"]; got != want {
+				t.Fatalf("client-%d: envelope = %v for request %d, %v for request 1", i, got, j, want)
+			}
+		}
+	}
+	// Without one every request is decided by itself.
+	in := 0
+	for i := 0; i < 1000; i++ {
+		if request("", strconv.Itoa(i))["envelope"] {
+			in++
+		}
+	}
+	if in < 400 || in > 600 {
+		t.Errorf("%d of 1000 requests without X-Client-Id are in a 50%% rollout", in)
+	}
+}
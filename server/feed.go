@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The feeds carry the latest -feed_size messages of a channel, newest first.
+// An entry is identified by the URL of its message, which stays the same
+// when the message is edited.
+
+type feedEntry struct {
+	id       string
+	message  string
+	created  time.Time
+	modified time.Time
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssFeed struct {
+	XMLName       xml.Name  `xml:"rss"`
+	Version       string    `xml:"version,attr"`
+	Title         string    `xml:"channel>title"`
+	Link          string    `xml:"channel>link"`
+	Description   string    `xml:"channel>description"`
+	LastBuildDate string    `xml:"channel>lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"channel>item"`
+}
+
+// baseURL is the scheme and host links in feeds point at, -public_url or
+// the host the request was sent to.
+func baseURL(r *http.Request) string {
+	if public_url != "" {
+		return strings.TrimSuffix(public_url, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedTitle is the first line of a message, shortened to 80 characters.
+func feedTitle(message string) string {
+	title := strings.TrimSpace(strings.SplitN(message, "\n", 2)[0])
+	if utf8.RuneCountInString(title) > 80 {
+		title = string([]rune(title)[:79]) + "…"
+	}
+	return title
+}
+
+func latestEntries(db *sql.DB, channel string) ([]feedEntry, error) {
+	rows, err := db.Query("SELECT id, message, key_id, UNIX_TIMESTAMP(timestamp), UNIX_TIMESTAMP(COALESCE(updated_at, timestamp)) FROM messages WHERE channel = ? AND flagged = 0 ORDER BY id DESC LIMIT ?", channel, feed_size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []feedEntry
+	for rows.Next() {
+		var e feedEntry
+		var created, modified int64
+		var keyID sql.NullString
+		if err := rows.Scan(&e.id, &e.message, &keyID, &created, &modified); err != nil {
+			return nil, err
+		}
+		if e.message, err = openBody(e.message, keyID); err != nil {
+			return nil, err
+		}
+		e.created, e.modified = time.Unix(created, 0).UTC(), time.Unix(modified, 0).UTC()
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// feed serves /feed.xml and /feed.rss. The ETag covers the ids and versions
+// of the entries, so deletes and edits change it as well as new messages.
+func feed(format string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, "Only GET method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		var entries []feedEntry
+		err = withRetry(r.Context(), "feed", func() (err error) {
+			entries, err = latestEntries(db, channelOf(r).name)
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get messages from db")
+			return
+		}
+
+		var updated time.Time
+		hash := sha256.New()
+		for _, e := range entries {
+			if e.modified.After(updated) {
+				updated = e.modified
+			}
+			fmt.Fprintf(hash, "%s:%d\n", e.id, e.modified.Unix())
+		}
+		etag := `"` + hex.EncodeToString(hash.Sum(nil))[:16] + `"`
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Cache-Control", "public, max-age=60")
+		if !updated.IsZero() {
+			rw.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+		}
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			if match == etag || match == "*" {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.IsZero() && !updated.After(since) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		base := baseURL(r) + channelOf(r).prefix()
+		title := "simple-http-server " + channelOf(r).name
+		var doc interface{}
+		if format == "atom" {
+			rw.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+			f := atomFeed{
+				ID:      base + "/messages",
+				Title:   title,
+				Updated: updated.Format(time.RFC3339),
+				Author:  "simple-http-server",
+				Links:   []atomLink{{Href: base + "/feed.xml", Rel: "self"}, {Href: base + "/messages"}},
+			}
+			for _, e := range entries {
+				link := base + "/messages/" + e.id
+				f.Entries = append(f.Entries, atomEntry{
+					ID:        link,
+					Title:     feedTitle(e.message),
+					Link:      atomLink{Href: link},
+					Published: e.created.Format(time.RFC3339),
+					Updated:   e.modified.Format(time.RFC3339),
+					Content:   atomContent{Type: "html", Body: renderMarkdown(e.message)},
+				})
+			}
+			doc = f
+		} else {
+			rw.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+			f := rssFeed{
+				Version:     "2.0",
+				Title:       title,
+				Link:        base + "/messages",
+				Description: "Latest messages of " + channelOf(r).name,
+			}
+			if !updated.IsZero() {
+				f.LastBuildDate = updated.Format(time.RFC1123Z)
+			}
+			for _, e := range entries {
+				link := base + "/messages/" + e.id
+				f.Items = append(f.Items, rssItem{
+					Title:       feedTitle(e.message),
+					Link:        link,
+					GUID:        rssGUID{IsPermaLink: true, Value: link},
+					PubDate:     e.created.Format(time.RFC1123Z),
+					Description: renderMarkdown(e.message),
+				})
+			}
+			doc = f
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+		fmt.Fprint(rw, xml.Header)
+		enc := xml.NewEncoder(rw)
+		enc.Indent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			log.Println(err)
+		}
+	})
+}
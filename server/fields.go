@@ -0,0 +1,140 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ?fields=id,message on /messages, /messages/{id} and /messages/batch
+// returns only those fields of the messages, and reads only the columns and
+// details they need. JSON and MessagePack bodies leave the others out,
+// protobuf ones leave them empty.
+
+var messageFields = []string{"id", "message", "created_at", "tags", "reactions", "attachments"}
+
+// A fieldSet is the fields asked for, nil for all of them.
+type fieldSet map[string]bool
+
+// parseFields parses ?fields=, a comma separated list of message fields.
+func parseFields(r *http.Request) (fieldSet, error) {
+	spec := r.URL.Query().Get("fields")
+	if spec == "" {
+		return nil, nil
+	}
+	f := fieldSet{}
+	for _, name := range splitList(spec) {
+		known := false
+		for _, field := range messageFields {
+			known = known || name == field
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown field %q, fields are %s!", name, strings.Join(messageFields, ", "))
+		}
+		f[name] = true
+	}
+	if len(f) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f fieldSet) has(name string) bool {
+	return f == nil || f[name]
+}
+
+// query returns what wraps the WHERE clause of a query of the fields, like
+// selectMessages and groupMessages; scanMessage reads its rows. The id,
+// modification time and version are always read for paging and ETags.
+func (f fieldSet) query() (selectClause, groupClause string) {
+	if f == nil {
+		return selectMessages, groupMessages
+	}
+	selectClause, groupClause = "SELECT m.id", " GROUP BY m.id"
+	if f.has("message") {
+		selectClause += ", m.message"
+		groupClause += ", m.message"
+	}
+	if f.has("created_at") {
+		selectClause += ", m.timestamp"
+		groupClause += ", m.timestamp"
+	}
+	selectClause += ", UNIX_TIMESTAMP(COALESCE(m.updated_at, m.timestamp)), m.version"
+	groupClause += ", m.updated_at, m.version"
+	if f.has("tags") {
+		selectClause += ", GROUP_CONCAT(t.name ORDER BY t.name)"
+	}
+	if f.has("message") {
+		selectClause += ", m.key_id"
+		groupClause += ", m.key_id"
+	}
+	selectClause += " FROM messages m"
+	if f.has("tags") {
+		selectClause += " LEFT JOIN message_tags mt ON mt.message_id = m.id LEFT JOIN tags t ON t.id = mt.tag_id"
+	} else {
+		groupClause = ""
+	}
+	return selectClause, groupClause
+}
+
+// scanMessage reads a row of the query of the fields into msg. tags and
+// keyID are scanned into, callers reading many rows reuse them.
+func (f fieldSet) scanMessage(scan func(dest ...interface{}) error, msg *messageType, tags, keyID *sql.NullString) error {
+	dest := make([]interface{}, 0, 7)
+	dest = append(dest, &msg.Id)
+	if f.has("message") {
+		dest = append(dest, &msg.Message)
+	}
+	if f.has("created_at") {
+		dest = append(dest, &msg.Timestamp)
+	}
+	dest = append(dest, &msg.Modified, &msg.Version)
+	if f.has("tags") {
+		dest = append(dest, tags)
+	}
+	if f.has("message") {
+		dest = append(dest, keyID)
+	}
+	if err := scan(dest...); err != nil {
+		return err
+	}
+	if f.has("tags") {
+		msg.Tags = splitTags(*tags)
+	}
+	if f.has("message") {
+		var err error
+		msg.Message, err = openBody(msg.Message, *keyID)
+		return err
+	}
+	return nil
+}
+
+// shape returns v, messages or a list of them, as the codec c should encode
+// it with only the fields asked for.
+func (f fieldSet) shape(c *codec, v interface{}) (interface{}, error) {
+	if f == nil || c == protobufCodec {
+		return v, nil
+	}
+	g, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return f.filter(g), nil
+}
+
+func (f fieldSet) filter(g interface{}) interface{} {
+	switch g := g.(type) {
+	case []interface{}:
+		for i := range g {
+			g[i] = f.filter(g[i])
+		}
+	case map[string]interface{}:
+		for name := range g {
+			if !f[name] {
+				delete(g, name)
+			}
+		}
+	}
+	return g
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Plain text answers, the errors and "... is inserted.", are translated to
+// the language of the Accept-Language header when there is a catalog for
+// it, English stays the default. Catalogs are the JSON files in locales,
+// named by language, mapping the English text to its translation. Texts
+// put together with fmt are keyed by their format, the translation has the
+// same verbs in the same order and gets the values of the English text.
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+type catalog struct {
+	exact    map[string]string
+	patterns []localePattern
+}
+
+type localePattern struct {
+	re          *regexp.Regexp
+	translation string
+}
+
+var catalogs = map[string]*catalog{}
+
+var formatVerb = regexp.MustCompile(`%[sdqv]`)
+
+func init() {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, f := range files {
+		b, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		var texts map[string]string
+		if err := json.Unmarshal(b, &texts); err != nil {
+			panic("locales/" + f.Name() + ": " + err.Error())
+		}
+		c := &catalog{exact: map[string]string{}}
+		for english, translated := range texts {
+			if !formatVerb.MatchString(english) {
+				c.exact[english] = translated
+				continue
+			}
+			literals := formatVerb.Split(english, -1)
+			for i := range literals {
+				literals[i] = regexp.QuoteMeta(literals[i])
+			}
+			re := regexp.MustCompile(`(?s)^` + strings.Join(literals, "(.+?)") + `$`)
+			c.patterns = append(c.patterns, localePattern{re: re, translation: translated})
+		}
+		// Longer formats are more specific, they are tried first.
+		sort.Slice(c.patterns, func(i, k int) bool { return len(c.patterns[i].re.String()) > len(c.patterns[k].re.String()) })
+		catalogs[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = c
+	}
+}
+
+// translate returns text in the language of c, or text when c has no
+// translation of it.
+func (c *catalog) translate(text string) string {
+	if t, ok := c.exact[text]; ok {
+		return t
+	}
+	for _, p := range c.patterns {
+		m := p.re.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		i := 0
+		return formatVerb.ReplaceAllStringFunc(p.translation, func(string) string {
+			if i++; i < len(m) {
+				return m[i]
+			}
+			return ""
+		})
+	}
+	return text
+}
+
+// negotiateLanguage picks the language with a catalog the Accept-Language
+// header prefers, "" when that is English or there is none. Regional tags
+// like de-AT fall back to their language.
+func negotiateLanguage(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		c := choice{lang: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					c.q = q
+				}
+			}
+		}
+		if c.lang != "" && c.q > 0 {
+			choices = append(choices, c)
+		}
+	}
+	sort.SliceStable(choices, func(i, k int) bool { return choices[i].q > choices[k].q })
+	for _, c := range choices {
+		lang := c.lang
+		if i := strings.IndexByte(lang, '-'); i >= 0 {
+			lang = lang[:i]
+		}
+		if lang == "en" || lang == "*" {
+			return ""
+		}
+		if catalogs[lang] != nil {
+			return lang
+		}
+	}
+	return ""
+}
+
+// localizing translates the plain text answers of requests preferring
+// another language. Those are buffered until the handler returns, anything
+// else is passed through, as is everything for clients content with
+// English.
+func localizing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+		if lang == "" {
+			next.ServeHTTP(&varyLanguageWriter{ResponseWriter: w}, r)
+			return
+		}
+		lw := &localizeWriter{ResponseWriter: w, lang: lang}
+		next.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
+
+// varyLanguageWriter marks the plain text answers left in English as
+// varying by Accept-Language, so caches do not hand them to clients asking
+// for a translation.
+type varyLanguageWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *varyLanguageWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if contentType := w.Header().Get("Content-Type"); contentType == "" || strings.HasPrefix(contentType, "text/plain") {
+			w.Header().Add("Vary", "Accept-Language")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *varyLanguageWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *varyLanguageWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type localizeWriter struct {
+	http.ResponseWriter
+	lang      string
+	status    int
+	buffering bool
+	passed    bool
+	body      bytes.Buffer
+}
+
+func (w *localizeWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	// Handlers leaving out the type are sniffed when they finish.
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" || strings.HasPrefix(contentType, "text/plain") {
+		w.buffering = true
+		return
+	}
+	w.pass()
+}
+
+func (w *localizeWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush gives up translating, what was written so far is sent as it is.
+func (w *localizeWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.pass()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// pass sends the status and what was buffered and lets the rest through.
+func (w *localizeWriter) pass() {
+	if w.passed {
+		return
+	}
+	w.passed, w.buffering = true, false
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body.Bytes())
+}
+
+func (w *localizeWriter) finish() {
+	if w.status == 0 || w.passed {
+		return
+	}
+	body := w.body.Bytes()
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	if strings.HasPrefix(contentType, "text/plain") {
+		text := string(body)
+		newline := strings.HasSuffix(text, "\n")
+		translated := catalogs[w.lang].translate(strings.TrimSuffix(text, "\n"))
+		if newline {
+			translated += "\n"
+		}
+		h := w.Header()
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Content-Language", w.lang)
+		h.Add("Vary", "Accept-Language")
+		h.Del("Content-Length")
+		w.body.Reset()
+		w.body.WriteString(translated)
+	}
+	w.pass()
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jobs are long running admin operations. They run in the background after
+// the request starting them returned its id, and report progress at
+// /admin/jobs/{id} until they are among the oldest beyond maxJobs.
+
+const maxJobs = 100
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+type job struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	ID       string            `json:"id"`
+	Kind     string            `json:"kind"`
+	Params   map[string]string `json:"params,omitempty"`
+	Status   string            `json:"status"`
+	Done     int               `json:"done"`
+	Error    string            `json:"error,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+}
+
+// progress adds n to the work the job has done.
+func (j *job) progress(n int) {
+	j.mu.Lock()
+	j.Done += n
+	j.mu.Unlock()
+}
+
+func (j *job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	type plain job
+	return json.Marshal((*plain)(j))
+}
+
+var jobs = struct {
+	sync.Mutex
+	byID map[string]*job
+}{byID: map[string]*job{}}
+
+var jobsFinished = newCounter("jobs_finished_total", "Background jobs that finished, by kind and status.", "kind", "status")
+
+// startJob runs fn in the background as a job of kind, cancelled with
+// parent, the background context of the server. The job fails when fn
+// returns an error and is cancelled when its context is.
+func startJob(parent context.Context, logger *log.Logger, kind string, params map[string]string, fn func(ctx context.Context, j *job) error) *job {
+	j, ctx := newJob(parent, kind, params)
+	if !goBackground(parent, func(context.Context) { j.run(ctx, logger, fn) }) {
+		// Shutdown began, the job is cancelled before it starts.
+		j.run(ctx, logger, func(ctx context.Context, j *job) error { return ctx.Err() })
+	}
+	return j
+}
+
+// backgroundWork is the work handlers started that outlives their request.
+var backgroundWork struct {
+	sync.Mutex
+	sync.WaitGroup
+}
+
+// goBackground runs fn in its own goroutine with ctx, the background
+// context of the server, and reports whether it did. Once ctx is cancelled
+// nothing is started anymore, and waitBackground waits for what was.
+func goBackground(ctx context.Context, fn func(ctx context.Context)) bool {
+	backgroundWork.Lock()
+	defer backgroundWork.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		fn(ctx)
+	}()
+	return true
+}
+
+// waitBackground waits for the work of goBackground after its context was
+// cancelled. Taking the lock lets a goBackground that saw the context alive
+// finish adding its work first.
+func waitBackground() {
+	backgroundWork.Lock()
+	backgroundWork.Unlock()
+	backgroundWork.Wait()
+}
+
+// newJob adds a running job of kind to the registry, cancelled with parent.
+func newJob(parent context.Context, kind string, params map[string]string) (*job, context.Context) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	ctx, cancel := context.WithCancel(parent)
+	j := &job{cancel: cancel, ID: hex.EncodeToString(b), Kind: kind, Params: params, Status: jobRunning, Started: time.Now().UTC()}
+
+	jobs.Lock()
+	if len(jobs.byID) >= maxJobs {
+		var oldest *job
+		for _, other := range jobs.byID {
+			other.mu.Lock()
+			finished := other.Status != jobRunning
+			other.mu.Unlock()
+			if finished && (oldest == nil || other.Started.Before(oldest.Started)) {
+				oldest = other
+			}
+		}
+		if oldest != nil {
+			delete(jobs.byID, oldest.ID)
+		}
+	}
+	jobs.byID[j.ID] = j
+	jobs.Unlock()
+	return j, ctx
+}
+
+// run runs fn as the job and returns its final status.
+func (j *job) run(ctx context.Context, logger *log.Logger, fn func(ctx context.Context, j *job) error) string {
+	defer j.cancel()
+	err := fn(ctx, j)
+	now := time.Now().UTC()
+	j.mu.Lock()
+	switch {
+	case ctx.Err() != nil:
+		j.Status = jobCancelled
+	case err != nil:
+		j.Status, j.Error = jobFailed, err.Error()
+	default:
+		j.Status = jobDone
+	}
+	j.Finished = &now
+	status, done := j.Status, j.Done
+	j.mu.Unlock()
+	jobsFinished.inc(j.Kind, status)
+	if err != nil && status == jobFailed {
+		logger.Printf("Job %s %s failed after %d: %v\n", j.Kind, j.ID, done, err)
+	} else {
+		logger.Printf("Job %s %s %s after %d\n", j.Kind, j.ID, status, done)
+	}
+	return status
+}
+
+// jobRoutes serves /admin/jobs, the recent jobs newest first, and
+// /admin/jobs/{id}, one of them. DELETE cancels a running job.
+func jobRoutes() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(rw, r) {
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/jobs"), "/")
+		if id == "" {
+			if r.Method != "GET" {
+				rw.Header().Set("Allow", "GET")
+				http.Error(rw, "Only GET method is allowed!", http.StatusMethodNotAllowed)
+				return
+			}
+			jobs.Lock()
+			out := make([]*job, 0, len(jobs.byID))
+			for _, j := range jobs.byID {
+				out = append(out, j)
+			}
+			jobs.Unlock()
+			sort.Slice(out, func(i, k int) bool { return out[i].Started.After(out[k].Started) })
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(out)
+			return
+		}
+		jobs.Lock()
+		j, ok := jobs.byID[id]
+		jobs.Unlock()
+		if !ok {
+			http.Error(rw, "Job not found", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "DELETE":
+			j.cancel()
+		default:
+			rw.Header().Set("Allow", "GET, DELETE")
+			http.Error(rw, "Only GET and DELETE methods are allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(j)
+	})
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestStartJobCancelledWithParent(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	parent, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	j := startJob(parent, logger, "test", nil, func(ctx context.Context, j *job) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		j.progress(1)
+		return nil
+	})
+	<-started
+	cancel()
+	waitBackground()
+	j.mu.Lock()
+	status, done := j.Status, j.Done
+	j.mu.Unlock()
+	if status != jobCancelled || done != 1 {
+		t.Errorf("after waitBackground job is %s with %d done, want cancelled with 1", status, done)
+	}
+
+	// Once the parent is cancelled jobs do not run at all.
+	ran := false
+	j = startJob(parent, logger, "test", nil, func(ctx context.Context, j *job) error {
+		ran = true
+		return nil
+	})
+	if ran || j.Status != jobCancelled {
+		t.Errorf("job started after cancel ran = %v, status %s", ran, j.Status)
+	}
+}
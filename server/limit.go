@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var requestsShed = newCounter("http_requests_shed_total", "Requests answered with 503 because the server was saturated, by reason.", "reason")
+
+// limiting lets at most max requests run at once. Up to queue more wait at
+// most wait for a slot; everything beyond that is shed with 503 and
+// Retry-After right away. Health checks and metrics are never limited so a
+// busy server is not taken for a dead one.
+func limiting(max, queue int, wait time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+		slots := make(chan struct{}, max)
+		var queued int32
+		newGaugeFunc("http_requests_in_flight", "Requests currently being served.", nil, func() []sample {
+			return []sample{{value: float64(len(slots))}}
+		})
+		newGaugeFunc("http_requests_queued", "Requests waiting for a slot.", nil, func() []sample {
+			return []sample{{value: float64(atomic.LoadInt32(&queued))}}
+		})
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if path := strings.TrimPrefix(r.URL.Path, base_path); path == "/health" || path == "/readyz" || path == "/metrics" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// Long polls spend their time waiting, they are bounded by
+			// -max_long_polls instead of holding a slot.
+			if strings.HasSuffix(r.URL.Path, "/messages") && isLongPoll(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			default:
+				if atomic.AddInt32(&queued, 1) > int32(queue) {
+					atomic.AddInt32(&queued, -1)
+					shed(w, "queue_full", wait)
+					return
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case slots <- struct{}{}:
+					timer.Stop()
+					atomic.AddInt32(&queued, -1)
+				case <-timer.C:
+					atomic.AddInt32(&queued, -1)
+					shed(w, "queue_timeout", wait)
+					return
+				case <-r.Context().Done():
+					timer.Stop()
+					atomic.AddInt32(&queued, -1)
+					return
+				}
+			}
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func shed(w http.ResponseWriter, reason string, wait time.Duration) {
+	requestsShed.inc(reason)
+	retry := int(wait.Seconds())
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(w, "Server is busy, try again later", http.StatusServiceUnavailable)
+}
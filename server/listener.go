@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// The listener of the standalone server bounds the connections it keeps
+// open, -max_conns in all and -max_conns_per_ip from one address, and sets
+// the TCP keepalive period of the connections it accepts. Connections over
+// a limit are closed right away, before anything is read from them.
+
+var connectionsRejected = newCounter("http_connections_rejected_total", "Connections closed when accepted, by the limit they were over: total or per_ip.", "limit")
+
+var openConnections int64
+
+func init() {
+	newGaugeFunc("http_open_connections", "Connections open to the server.", nil, func() []sample {
+		return []sample{{value: float64(atomic.LoadInt64(&openConnections))}}
+	})
+}
+
+// listen opens the listener at addr with the connection limits.
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: tcp_keepalive}
+	if tcp_keepalive == 0 {
+		lc.KeepAlive = -1
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &limitListener{Listener: ln, total: max_conns, perIP: max_conns_per_ip, byIP: map[string]int{}}, nil
+}
+
+type limitListener struct {
+	net.Listener
+	total, perIP int
+
+	mu   sync.Mutex
+	open int
+	byIP map[string]int
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(c.RemoteAddr())
+		if limit := l.acquire(ip); limit != "" {
+			connectionsRejected.inc(limit)
+			c.Close()
+			continue
+		}
+		atomic.AddInt64(&openConnections, 1)
+		return &limitedConn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// acquire counts a connection from ip, returning the limit it is over
+// instead when there is one.
+func (l *limitListener) acquire(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.total > 0 && l.open >= l.total {
+		return "total"
+	}
+	if l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return "per_ip"
+	}
+	l.open++
+	l.byIP[ip]++
+	return ""
+}
+
+func (l *limitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+	atomic.AddInt64(&openConnections, -1)
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// limitedConn gives its slot back when it is closed, once however often
+// the server closes it.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itzmanish/simple-http-server/client"
+)
+
+// loadgenWords are what generated messages are made of.
+var loadgenWords = strings.Fields(`the a deploy release build test message server queue cache
+	database replica shard index lunch meeting docs review ticket bug fix rollout alert page latency
+	throughput budget plan sprint backlog owner team **bold** _quiet_ today tomorrow soon now later`)
+
+var loadgenTags = []string{"ops", "release", "food", "docs", "greeting", "alerts"}
+
+// generateMessages makes count messages from seed, the same ones for the
+// same seed. Each carries its number so none is a duplicate of another.
+func generateMessages(seed int64, count, size int) []messageType {
+	rnd := rand.New(rand.NewSource(seed))
+	out := make([]messageType, count)
+	for i := range out {
+		var b strings.Builder
+		fmt.Fprintf(&b, "#%d", i+1)
+		for b.Len() < size {
+			b.WriteByte(' ')
+			b.WriteString(loadgenWords[rnd.Intn(len(loadgenWords))])
+		}
+		msg := messageType{Message: b.String()}
+		for _, j := range rnd.Perm(len(loadgenTags))[:rnd.Intn(3)] {
+			msg.Tags = append(msg.Tags, loadgenTags[j])
+		}
+		out[i] = msg
+	}
+	return out
+}
+
+// percentile is the latency below which p percent of the sorted latencies are.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// loadgen inserts generated messages into a channel at -rate per second,
+// straight into the database or through the API of the server at -target,
+// and reports the latencies of the inserts.
+func loadgen(fs *flag.FlagSet, args []string) error {
+	count := fs.Int("count", 1000, "Number of messages to insert")
+	channelName := fs.String("channel", defaultChannel, "Channel the messages are inserted into")
+	target := fs.String("target", "", "Base URL of a server to insert through, the database is written directly when empty")
+	rate := fs.Float64("rate", 0, "Inserts started per second, 0 for as fast as -concurrency allows")
+	concurrency := fs.Int("concurrency", 4, "Inserts running at once")
+	size := fs.Int("size", 80, "Approximate length of the generated messages")
+	seedValue := fs.Int64("seed", 1, "Seed of the generator, the same seed generates the same messages")
+	fs.Parse(args)
+	if *concurrency < 1 {
+		return errors.New("-concurrency must be at least 1")
+	}
+	if *size > maxMessageLength {
+		return fmt.Errorf("-size must be at most %d", maxMessageLength)
+	}
+	if err := configure(); err != nil {
+		return err
+	}
+	defer closeDB()
+	c, ok := channels[*channelName]
+	if !ok {
+		return fmt.Errorf("Channel %q is not configured", *channelName)
+	}
+
+	var insert func(ctx context.Context, msg messageType) error
+	if *target != "" {
+		opts := []client.Option{client.WithAccessKey(c.accessKey()), client.WithRetries(0, 0)}
+		if c.name != defaultChannel {
+			opts = append(opts, client.WithChannel(c.name))
+		}
+		api := client.New(*target, opts...)
+		insert = func(ctx context.Context, msg messageType) error {
+			return api.AddMessage(ctx, msg.Message, msg.Tags...)
+		}
+	} else {
+		db, err := initDB()
+		if err != nil {
+			return err
+		}
+		insert = func(ctx context.Context, msg messageType) error {
+			msg.Channel = c.name
+			msg.ContentHash = contentHash(c.name, c.accessKey(), msg.Message)
+			return withRetry(ctx, "insert_message", func() error {
+				return insertMessage(db, msg, nil)
+			})
+		}
+	}
+
+	messages := generateMessages(*seedValue, *count, *size)
+	jobs := make(chan messageType)
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if *rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for _, msg := range messages {
+			if tick != nil {
+				<-tick
+			}
+			jobs <- msg
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	latencies := make([]time.Duration, 0, len(messages))
+	failures := map[string]int{}
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range jobs {
+				began := time.Now()
+				err := insert(context.Background(), msg)
+				took := time.Since(began)
+				mu.Lock()
+				if err != nil {
+					failures[err.Error()]++
+				} else {
+					latencies = append(latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	how := "directly"
+	if *target != "" {
+		how = "through " + *target
+	}
+	fmt.Printf("Inserted %d of %d messages into channel %s %s in %s, %.1f/s\n", len(latencies), len(messages), c.name, how, elapsed.Round(time.Millisecond), float64(len(latencies))/elapsed.Seconds())
+	if len(latencies) > 0 {
+		fmt.Printf("Latency p50 %s, p90 %s, p99 %s, max %s\n", percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+	if len(failures) > 0 {
+		failed := 0
+		for msg, n := range failures {
+			fmt.Printf("%d failed: %s\n", n, msg)
+			failed += n
+		}
+		return fmt.Errorf("%d inserts failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// messageHub wakes up the requests waiting for new messages of a channel.
+// It only knows about messages published by this process, so waiters also
+// look at the database now and then to see messages added elsewhere.
+type messageHub struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+	count   int32
+	// closed is closed when the server shuts down, releasing every waiter.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var hub = messageHub{waiters: map[string]map[chan struct{}]bool{}, closed: make(chan struct{})}
+
+func init() {
+	newGaugeFunc("http_long_polls", "Requests waiting for new messages.", nil, func() []sample {
+		return []sample{{value: float64(atomic.LoadInt32(&hub.count))}}
+	})
+}
+
+// subscribe registers a waiter for channel. It returns false when
+// -max_long_polls requests are already waiting.
+func (h *messageHub) subscribe(channel string) (chan struct{}, func(), bool) {
+	if atomic.AddInt32(&h.count, 1) > int32(max_long_polls) {
+		atomic.AddInt32(&h.count, -1)
+		return nil, nil, false
+	}
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.waiters[channel] == nil {
+		h.waiters[channel] = map[chan struct{}]bool{}
+	}
+	h.waiters[channel][ch] = true
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.waiters[channel], ch)
+		if len(h.waiters[channel]) == 0 {
+			delete(h.waiters, channel)
+		}
+		h.mu.Unlock()
+		atomic.AddInt32(&h.count, -1)
+	}, true
+}
+
+// publish wakes the waiters of channel, or of every channel when it is
+// empty.
+func (h *messageHub) publish(channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, waiters := range h.waiters {
+		if channel != "" && name != channel {
+			continue
+		}
+		for ch := range waiters {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// close answers every waiting request, and those that start waiting later,
+// as if their wait passed.
+func (h *messageHub) close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// longPollRecheck is how often a waiting request looks at the database for
+// messages added by other instances.
+const longPollRecheck = 5 * time.Second
+
+// parseWait reads ?wait= of a listing, capped at -long_poll_max.
+func parseWait(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("wait")
+	if s == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(s)
+	if err != nil || wait < 0 {
+		return 0, errors.New("wait must be a duration like 30s!")
+	}
+	if wait > long_poll_max {
+		wait = long_poll_max
+	}
+	return wait, nil
+}
+
+// isLongPoll reports whether a listing waits for new messages. Those are
+// bounded by -max_long_polls and longPollRoute instead of the limits of
+// listings; ?wait=0s, or an invalid wait, is an ordinary listing.
+func isLongPoll(r *http.Request) bool {
+	wait, err := parseWait(r)
+	return err == nil && wait > 0
+}
+
+// waitForMessages holds a listing until a message matching where exists or
+// wait passes. It returns false when it answered the request itself, with
+// 204 when nothing arrived.
+func waitForMessages(rw http.ResponseWriter, r *http.Request, db *sql.DB, where string, args []interface{}, wait time.Duration) (bool, error) {
+	woken, unsubscribe, ok := hub.subscribe(channelOf(r).name)
+	if !ok {
+		shed(rw, "long_polls", time.Second)
+		return false, nil
+	}
+	defer unsubscribe()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	recheck := time.NewTicker(longPollRecheck)
+	defer recheck.Stop()
+	for {
+		var id int64
+		err := withRetry(r.Context(), "wait_messages", func() error {
+			return db.QueryRowContext(r.Context(), "SELECT m.id FROM messages m"+where+" LIMIT 1", args...).Scan(&id)
+		})
+		if err == nil {
+			return true, nil
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+		select {
+		case <-woken:
+		case <-recheck.C:
+		case <-timer.C:
+			rw.WriteHeader(http.StatusNoContent)
+			return false, nil
+		case <-hub.closed:
+			rw.WriteHeader(http.StatusNoContent)
+			return false, nil
+		case <-r.Context().Done():
+			return false, nil
+		}
+	}
+}
+
+// withLongPoll applies the timeout of /messages to listings and the one of
+// longPollRoute, none by default, to listings waiting for new messages.
+func withLongPoll(h http.Handler) http.Handler {
+	listing := withTimeout("/messages", h)
+	waiting := withTimeout(longPollRoute, h)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if isLongPoll(r) {
+			waiting.ServeHTTP(rw, r)
+			return
+		}
+		listing.ServeHTTP(rw, r)
+	})
+}
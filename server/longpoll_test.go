@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsLongPoll(t *testing.T) {
+	defer func(max time.Duration) { long_poll_max = max }(long_poll_max)
+	long_poll_max = time.Minute
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", false},
+		{"?all=true", false},
+		{"?wait=0s&all=true", false},
+		{"?wait=0", false},
+		{"?wait=-5s", false},
+		{"?wait=soon", false},
+		{"?wait=1ms", true},
+		{"?wait=30s", true},
+		{"?wait=1h", true},
+	}
+	for _, tt := range tests {
+		if got := isLongPoll(httptest.NewRequest("GET", "/messages"+tt.query, nil)); got != tt.want {
+			t.Errorf("isLongPoll(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
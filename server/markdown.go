@@ -0,0 +1,292 @@
+package server
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The renderer turns message bodies written in a small Markdown subset
+// (headings, paragraphs, emphasis, code, links, lists, quotes and rules) into
+// a tree of nodes. Raw HTML in a message is never interpreted, it ends up as
+// escaped text. Before being written out the tree still goes through an
+// allowlist sanitizer, so whatever the parser produces, only the elements and
+// attributes listed there can reach a browser.
+
+type mdNode struct {
+	tag      string // empty for text nodes
+	text     string
+	attrs    [][2]string
+	children []*mdNode
+}
+
+func element(tag string, children ...*mdNode) *mdNode {
+	return &mdNode{tag: tag, children: children}
+}
+
+func textNode(text string) *mdNode {
+	return &mdNode{text: text}
+}
+
+// allowedElements maps every element that may be rendered to the attributes
+// it may carry.
+var allowedElements = map[string][]string{
+	"p": nil, "br": nil, "hr": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"strong": nil, "em": nil, "code": nil, "pre": nil, "blockquote": nil,
+	"ul": nil, "ol": nil, "li": nil,
+	"a": {"href"},
+}
+
+var voidElements = map[string]bool{"br": true, "hr": true}
+
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+var (
+	headingLine     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	ruleLine        = regexp.MustCompile(`^\s{0,3}([-*_])(\s*[-*_]){2,}\s*$`)
+	bulletLine      = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	orderedLine     = regexp.MustCompile(`^\s{0,3}\d{1,9}[.)]\s+(.*)$`)
+	quoteLine       = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	fenceLine       = regexp.MustCompile("^\\s{0,3}(```|~~~)")
+	autolinkPattern = regexp.MustCompile(`^<((?:https?|mailto):[^<>\s]+)>`)
+)
+
+// renderMarkdown renders a message body to sanitized HTML.
+func renderMarkdown(src string) string {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	for _, n := range parseBlocks(lines) {
+		writeNode(&b, sanitize(n)...)
+	}
+	return b.String()
+}
+
+func parseBlocks(lines []string) []*mdNode {
+	var blocks []*mdNode
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+		case fenceLine.MatchString(line):
+			fence := fenceLine.FindStringSubmatch(line)[1]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			i++ // closing fence
+			blocks = append(blocks, element("pre", element("code", textNode(strings.Join(code, "\n")))))
+		case headingLine.MatchString(line):
+			m := headingLine.FindStringSubmatch(line)
+			blocks = append(blocks, element("h"+string(rune('0'+len(m[1]))), parseInline(m[2])...))
+			i++
+		case ruleLine.MatchString(line):
+			blocks = append(blocks, element("hr"))
+			i++
+		case quoteLine.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && quoteLine.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteLine.FindStringSubmatch(lines[i])[1])
+			}
+			blocks = append(blocks, element("blockquote", parseBlocks(quoted)...))
+		case bulletLine.MatchString(line), orderedLine.MatchString(line):
+			pattern, tag := bulletLine, "ul"
+			if !bulletLine.MatchString(line) {
+				pattern, tag = orderedLine, "ol"
+			}
+			list := element(tag)
+			for ; i < len(lines) && pattern.MatchString(lines[i]); i++ {
+				list.children = append(list.children, element("li", parseInline(pattern.FindStringSubmatch(lines[i])[1])...))
+			}
+			blocks = append(blocks, list)
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && !startsBlock(lines[i]); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			p := element("p")
+			for j, l := range para {
+				if j > 0 {
+					p.children = append(p.children, element("br"))
+				}
+				p.children = append(p.children, parseInline(l)...)
+			}
+			blocks = append(blocks, p)
+		}
+	}
+	return blocks
+}
+
+func startsBlock(line string) bool {
+	return fenceLine.MatchString(line) || headingLine.MatchString(line) || ruleLine.MatchString(line) ||
+		quoteLine.MatchString(line) || bulletLine.MatchString(line) || orderedLine.MatchString(line)
+}
+
+// parseInline handles code spans, emphasis, links and backslash escapes.
+func parseInline(s string) []*mdNode {
+	var out []*mdNode
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			out = append(out, textNode(text.String()))
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()<>#+-.!", s[i+1]) >= 0:
+			text.WriteByte(s[i+1])
+			i += 2
+			continue
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end >= 0 {
+				flush()
+				out = append(out, element("code", textNode(s[i+1:i+1+end])))
+				i += end + 2
+				continue
+			}
+		case c == '*' || c == '_':
+			delim, tag := s[i:i+1], "em"
+			if strings.HasPrefix(s[i:], strings.Repeat(delim, 2)) {
+				delim, tag = delim+delim, "strong"
+			}
+			if end := strings.Index(s[i+len(delim):], delim); end > 0 {
+				flush()
+				inner := s[i+len(delim) : i+len(delim)+end]
+				out = append(out, element(tag, parseInline(inner)...))
+				i += len(delim)*2 + end
+				continue
+			}
+		case c == '[':
+			if label, href, n, ok := parseLink(s[i:]); ok {
+				flush()
+				a := element("a", parseInline(label)...)
+				a.attrs = [][2]string{{"href", href}}
+				out = append(out, a)
+				i += n
+				continue
+			}
+		case c == '<':
+			if m := autolinkPattern.FindStringSubmatch(s[i:]); m != nil {
+				flush()
+				a := element("a", textNode(m[1]))
+				a.attrs = [][2]string{{"href", m[1]}}
+				out = append(out, a)
+				i += len(m[0])
+				continue
+			}
+		}
+		text.WriteByte(c)
+		i++
+	}
+	flush()
+	return out
+}
+
+// parseLink parses [label](href) at the start of s, returning the number of
+// bytes it spans.
+func parseLink(s string) (label, href string, n int, ok bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				if !strings.HasPrefix(s[i+1:], "(") {
+					return "", "", 0, false
+				}
+				// Parentheses inside the destination have to be balanced.
+				parens := 0
+				for j := i + 2; j < len(s); j++ {
+					switch s[j] {
+					case '(':
+						parens++
+					case ')':
+						if parens == 0 {
+							return s[1:i], strings.TrimSpace(s[i+2 : j]), j + 1, true
+						}
+						parens--
+					}
+				}
+				return "", "", 0, false
+			}
+		}
+	}
+	return "", "", 0, false
+}
+
+// sanitize returns n with every element that is not allowlisted replaced by
+// its children and every attribute that is not allowlisted dropped. Links
+// with a scheme other than http, https or mailto lose their href.
+func sanitize(n *mdNode) []*mdNode {
+	if n.tag == "" {
+		return []*mdNode{n}
+	}
+	var children []*mdNode
+	for _, c := range n.children {
+		children = append(children, sanitize(c)...)
+	}
+	allowedAttrs, ok := allowedElements[n.tag]
+	if !ok {
+		return children
+	}
+	clean := &mdNode{tag: n.tag, children: children}
+	for _, attr := range n.attrs {
+		if !contains(allowedAttrs, attr[0]) {
+			continue
+		}
+		if attr[0] == "href" && !safeURL(attr[1]) {
+			continue
+		}
+		clean.attrs = append(clean.attrs, attr)
+	}
+	if n.tag == "a" {
+		clean.attrs = append(clean.attrs, [2]string{"rel", "nofollow noopener noreferrer"})
+	}
+	return []*mdNode{clean}
+}
+
+func safeURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	// Relative links have no scheme and cannot run script.
+	return u.Scheme == "" && u.Opaque == "" || allowedSchemes[strings.ToLower(u.Scheme)]
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func writeNode(b *strings.Builder, nodes ...*mdNode) {
+	for _, n := range nodes {
+		if n.tag == "" {
+			b.WriteString(html.EscapeString(n.text))
+			continue
+		}
+		b.WriteString("<" + n.tag)
+		for _, attr := range n.attrs {
+			b.WriteString(" " + attr[0] + `="` + html.EscapeString(attr[1]) + `"`)
+		}
+		b.WriteString(">")
+		if voidElements[n.tag] {
+			continue
+		}
+		writeNode(b, n.children...)
+		b.WriteString("</" + n.tag + ">")
+		if n.tag != "a" && n.tag != "strong" && n.tag != "em" && n.tag != "code" {
+			b.WriteString("\n")
+		}
+	}
+}
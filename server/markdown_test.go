@@ -0,0 +1,89 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{"https://example.com/a?b=c", true},
+		{"http://example.com", true},
+		{"mailto:someone@example.com", true},
+		{"/relative/path", true},
+		{"#fragment", true},
+		{"//example.com", true},
+		{"javascript:alert(1)", false},
+		{"JaVaScRiPt:alert(1)", false},
+		{"vbscript:msgbox(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"file:///etc/passwd", false},
+		{" javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		// Entities are not decoded, this is the relative path "jav&".
+		{"jav&#x61;script:alert(1)", true},
+	}
+	for _, tt := range tests {
+		if got := safeURL(tt.raw); got != tt.want {
+			t.Errorf("safeURL(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		// Raw HTML is text, never markup.
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"```\n<img src=x onerror=alert(1)>\n```", "<pre><code>&lt;img src=x onerror=alert(1)&gt;</code></pre>\n"},
+		{"**bold** and _em_ `<b>`", "<p><strong>bold</strong> and <em>em</em> <code>&lt;b&gt;</code></p>\n"},
+		{"\\*not em\\*", "<p>*not em*</p>\n"},
+		// Unsafe links lose their href, all keep rel.
+		{"[x](javascript:alert(1))", "<p><a rel=\"nofollow noopener noreferrer\">x</a></p>\n"},
+		{"[x](JaVaScRiPt:alert(1))", "<p><a rel=\"nofollow noopener noreferrer\">x</a></p>\n"},
+		{"[x](https://example.com/a_(b))", "<p><a href=\"https://example.com/a_(b)\" rel=\"nofollow noopener noreferrer\">x</a></p>\n"},
+		{"[<img>](https://a.b/\"onmouseover=\"x)", "<p><a href=\"https://a.b/&#34;onmouseover=&#34;x\" rel=\"nofollow noopener noreferrer\">&lt;img&gt;</a></p>\n"},
+		{"<https://example.com>", "<p><a href=\"https://example.com\" rel=\"nofollow noopener noreferrer\">https://example.com</a></p>\n"},
+		{"<javascript:alert(1)>", "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		// Blocks.
+		{"line one\nline two", "<p>line one<br>line two</p>\n"},
+		{"# Title\n\n- a\n- b\n\n> quote\n\n---", "<h1>Title</h1>\n<ul><li>a</li>\n<li>b</li>\n</ul>\n<blockquote><p>quote</p>\n</blockquote>\n<hr>"},
+		{"1. one\n2. two", "<ol><li>one</li>\n<li>two</li>\n</ol>\n"},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.src); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	link := func(attrs ...[2]string) *mdNode {
+		n := element("a", textNode("x"))
+		n.attrs = attrs
+		return n
+	}
+	tests := []struct {
+		name string
+		node *mdNode
+		want string
+	}{
+		{"unknown element keeps its children", element("p", element("script", textNode("alert(1)"))), "<p>alert(1)</p>\n"},
+		{"nested unknown elements", element("iframe", element("object", element("em", textNode("x")))), "<em>x</em>"},
+		{"disallowed attribute", link([2]string{"href", "/a"}, [2]string{"onclick", "alert(1)"}), "<a href=\"/a\" rel=\"nofollow noopener noreferrer\">x</a>"},
+		{"unsafe href", link([2]string{"href", "javascript:alert(1)"}), "<a rel=\"nofollow noopener noreferrer\">x</a>"},
+		{"rel is replaced", link([2]string{"href", "/a"}, [2]string{"rel", "opener"}), "<a href=\"/a\" rel=\"nofollow noopener noreferrer\">x</a>"},
+		{"text is escaped", element("p", textNode("<b>&</b>")), "<p>&lt;b&gt;&amp;&lt;/b&gt;</p>\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		writeNode(&b, sanitize(tt.node)...)
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A small registry of metrics served in the Prometheus text format at
+// /metrics. Counters and histograms are updated as things happen, gauges are
+// collected from functions at scrape time.
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []metric
+)
+
+func register(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	registry = append(registry, m)
+}
+
+// sample is one value of a metric with its label values.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]*sample{}}
+	register(c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labels: labelValues}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	samples := make([]sample, 0, len(c.values))
+	for _, s := range c.values {
+		samples = append(samples, *s)
+	}
+	c.mu.Unlock()
+	writeSamples(w, c.name, c.help, "counter", c.labels, samples)
+}
+
+// histogramVec counts observations into cumulative buckets, with their sum
+// and count, like a Prometheus histogram.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramSample
+}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramSample{}}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSample{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	samples := make([]histogramSample, 0, len(h.values))
+	for _, s := range h.values {
+		c := *s
+		c.counts = append([]uint64(nil), s.counts...)
+		samples = append(samples, c)
+	}
+	h.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, s := range samples {
+		values := append(append([]string(nil), s.labels...), "")
+		for i, upper := range h.buckets {
+			values[len(values)-1] = formatValue(upper)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+type gaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() []sample
+}
+
+func newGaugeFunc(name, help string, labels []string, collect func() []sample) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	register(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	writeSamples(w, g.name, g.help, "gauge", g.labels, g.collect())
+}
+
+func writeSamples(w io.Writer, name, help, kind string, labels []string, samples []sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, s.labels), formatValue(s.value))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metricsMu.Lock()
+		metrics := append([]metric(nil), registry...)
+		metricsMu.Unlock()
+		for _, m := range metrics {
+			m.writeTo(w)
+		}
+	})
+}
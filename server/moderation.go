@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// verdict is what a moderator thinks of a message. Terms lists the offending
+// parts of the text when the moderator knows them, which is what redaction
+// needs.
+type verdict struct {
+	Flagged bool     `json:"flagged"`
+	Reason  string   `json:"reason"`
+	Terms   []string `json:"terms"`
+}
+
+type moderator interface {
+	moderate(ctx context.Context, text string) (verdict, error)
+}
+
+// moderators run in order on every new message, the first one flagging it
+// decides. It is empty when moderation is not configured.
+var moderators []moderator
+
+func newModerators() ([]moderator, error) {
+	switch moderation_action {
+	case "reject", "flag", "redact":
+	default:
+		return nil, fmt.Errorf("unknown moderation action %q, use reject, flag or redact", moderation_action)
+	}
+	var out []moderator
+	words := splitList(moderation_words)
+	if moderation_words_file != "" {
+		fileWords, err := readWordList(moderation_words_file)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, fileWords...)
+	}
+	if len(words) > 0 {
+		out = append(out, newWordListModerator(words))
+	}
+	if moderation_url != "" {
+		out = append(out, &httpModerator{url: moderation_url, client: newHTTPClient("moderation", moderation_timeout)})
+	}
+	return out, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// readWordList reads one word or phrase per line, skipping blank lines and
+// # comments.
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// wordListModerator flags messages containing any of a list of words, matched
+// case-insensitively on word boundaries.
+type wordListModerator struct {
+	pattern *regexp.Regexp
+}
+
+func newWordListModerator(words []string) *wordListModerator {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return &wordListModerator{pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)}
+}
+
+func (m *wordListModerator) moderate(ctx context.Context, text string) (verdict, error) {
+	terms := m.pattern.FindAllString(text, -1)
+	if len(terms) == 0 {
+		return verdict{}, nil
+	}
+	return verdict{Flagged: true, Reason: "word list", Terms: terms}, nil
+}
+
+// httpModerator asks an external moderation service. It is sent
+// {"message": "..."} and answers with a verdict.
+type httpModerator struct {
+	url    string
+	client *http.Client
+}
+
+func (m *httpModerator) moderate(ctx context.Context, text string) (verdict, error) {
+	var v verdict
+	body, err := json.Marshal(map[string]string{"message": text})
+	if err != nil {
+		return v, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", m.url, bytes.NewReader(body))
+	if err != nil {
+		return v, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return v, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return v, fmt.Errorf("moderation service answered %s", resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&v)
+	if v.Flagged && v.Reason == "" {
+		v.Reason = "moderation service"
+	}
+	return v, err
+}
+
+// rejectedError is returned for messages refused by moderation.
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return "Message is not allowed: " + e.reason
+}
+
+// moderateMessage runs the moderators over msg and applies the configured
+// action: rejecting it, flagging it for review or redacting the offending
+// terms. Redaction falls back to flagging when a moderator did not say which
+// terms were the problem.
+func moderateMessage(ctx context.Context, msg *messageType) error {
+	for _, m := range moderators {
+		v, err := m.moderate(ctx, msg.Message)
+		if err != nil {
+			if moderation_fail_open {
+				log.Println("Moderation failed, accepting message:", err)
+				continue
+			}
+			return err
+		}
+		if !v.Flagged {
+			continue
+		}
+		switch {
+		case moderation_action == "reject":
+			return &rejectedError{reason: v.Reason}
+		case moderation_action == "redact" && len(v.Terms) > 0:
+			msg.Message = redactTerms(msg.Message, v.Terms)
+		default:
+			msg.Flagged = true
+			msg.FlagReason = v.Reason
+			return nil
+		}
+	}
+	return nil
+}
+
+func redactTerms(text string, terms []string) string {
+	for _, term := range terms {
+		pattern := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(term))
+		text = pattern.ReplaceAllStringFunc(text, func(s string) string {
+			return strings.Repeat("*", len([]rune(s)))
+		})
+	}
+	return text
+}
+
+// adminAuthorized checks the admin key of a request to the /admin endpoints.
+// They are disabled while no admin key is configured.
+func adminAuthorized(rw http.ResponseWriter, r *http.Request) bool {
+	key := adminKey()
+	if key == "" {
+		http.Error(rw, "Admin endpoints are disabled", http.StatusForbidden)
+		return false
+	}
+	if r.URL.Query().Get("admin_key") != key {
+		http.Error(rw, "Admin key is not valid", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+var adminSignedRequests = newCounter("http_admin_signed_requests_total", "Destructive admin requests checked for their signature, by result.", "result")
+
+// adminSigned authenticates a destructive admin request, which is signed
+// with the admin key like signed requests are with the access key instead
+// of carrying it, so a captured one cannot be sent again: its X-Timestamp
+// must be within -admin_max_skew and its X-Nonce is spent. With
+// -admin_max_skew=0 the admin key is enough, as for the other calls.
+func adminSigned(rw http.ResponseWriter, r *http.Request) bool {
+	if admin_max_skew == 0 {
+		return adminAuthorized(rw, r)
+	}
+	key := adminKey()
+	if key == "" {
+		http.Error(rw, "Admin endpoints are disabled", http.StatusForbidden)
+		return false
+	}
+	if r.Header.Get("X-Signature") == "" {
+		adminSignedRequests.inc("unsigned")
+		http.Error(rw, "Destructive admin calls must be signed!", http.StatusUnauthorized)
+		return false
+	}
+	if err := verifySignature(r, key, "/admin", admin_max_skew); err != nil {
+		adminSignedRequests.inc("rejected")
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	adminSignedRequests.inc("accepted")
+	return true
+}
+
+type flaggedMessage struct {
+	messageType
+	Channel    string `json:"channel"`
+	FlagReason string `json:"flag_reason"`
+}
+
+// flaggedMessages lists the messages held for review at /admin/flagged.
+func flaggedMessages() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(rw, r) {
+			return
+		}
+		p, err := parsePage(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		db, err := initDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		query := "SELECT id, channel, message, key_id, timestamp, flag_reason FROM messages WHERE flagged = 1 AND id > ? ORDER BY id"
+		args := []interface{}{p.AfterID}
+		if p.Limit > 0 {
+			query += " LIMIT ?"
+			args = append(args, p.Limit)
+		}
+		var rows *sql.Rows
+		err = withRetry(r.Context(), "list_flagged", func() (err error) {
+			rows, err = db.Query(query, args...)
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to get messages from db", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []flaggedMessage{}
+		for rows.Next() {
+			var temp flaggedMessage
+			var reason, keyID sql.NullString
+			err := rows.Scan(&temp.Id, &temp.Channel, &temp.Message, &keyID, &temp.Timestamp, &reason)
+			if err == nil {
+				temp.Message, err = openBody(temp.Message, keyID)
+			}
+			if err != nil {
+				log.Println(err)
+				http.Error(rw, "Unable to get messages from db", http.StatusInternalServerError)
+				return
+			}
+			temp.FlagReason = reason.String
+			out = append(out, temp)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to get messages from db", http.StatusInternalServerError)
+			return
+		}
+		if p.Limit > 0 && len(out) == p.Limit {
+			rw.Header().Set("Link", nextPageLink(r, out[len(out)-1].Id, p))
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
+
+// reviewFlagged handles POST /admin/flagged/{id}/approve, which publishes a
+// held message, and POST /admin/flagged/{id}/remove, which deletes it.
+func reviewFlagged(messageID int64, action string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "Only POST method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		authorized := adminAuthorized
+		if action == "remove" {
+			authorized = adminSigned
+		}
+		if !authorized(rw, r) {
+			return
+		}
+		db, err := initDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		switch action {
+		case "approve":
+			var channel string
+			err := withRetry(r.Context(), "approve_message", func() (err error) {
+				channel, err = approveMessage(db, messageID)
+				return err
+			})
+			if err == sql.ErrNoRows {
+				http.Error(rw, "Flagged message not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Println(err)
+				storeError(rw, err, "Unable to approve message")
+				return
+			}
+			hub.publish(channel)
+		case "remove":
+			var keys []string
+			err := withRetry(r.Context(), "remove_message", func() (err error) {
+				keys, err = removeMessage(db, "", messageID, nil, true)
+				return err
+			})
+			if err == sql.ErrNoRows {
+				http.Error(rw, "Flagged message not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Println(err)
+				storeError(rw, err, "Unable to delete message")
+				return
+			}
+			deleteBlobs(r.Context(), keys)
+		default:
+			http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// approveMessage publishes a message held for review and returns its
+// channel.
+func approveMessage(db *sql.DB, messageID int64) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE messages SET flagged = 0, flag_reason = NULL WHERE id = ? AND flagged = 1", messageID)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", sql.ErrNoRows
+	}
+	var channel string
+	if err := tx.QueryRow("SELECT channel FROM messages WHERE id = ?", messageID).Scan(&channel); err != nil {
+		return "", err
+	}
+	if err := recordEvent(tx, eventCreated, messageID); err != nil {
+		return "", err
+	}
+	return channel, commit(tx)
+}
+
+// adminFlaggedRoutes dispatches the /admin/flagged/{id}/{action} subtree.
+func adminFlaggedRoutes() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/flagged/"), "/"), "/")
+		id, err := parseID(parts[0])
+		if err != nil || len(parts) != 2 {
+			http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		reviewFlagged(id, parts[1]).ServeHTTP(rw, r)
+	})
+}
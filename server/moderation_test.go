@@ -0,0 +1,26 @@
+package server
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestApproveMessage(t *testing.T) {
+	db := setupStore(t)
+	res, err := db.Exec("INSERT INTO messages(message, channel, flagged, flag_reason) VALUES ('held', 'ops', 1, 'spam')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	channel, err := approveMessage(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel != "ops" {
+		t.Errorf("channel = %q, want %q", channel, "ops")
+	}
+	// A message is approved only once.
+	if _, err := approveMessage(db, id); err != sql.ErrNoRows {
+		t.Errorf("second approve: error = %v, want %v", err, sql.ErrNoRows)
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// msgpackCodec encodes bodies in MessagePack with the same field names as
+// JSON. Map keys are sorted so equal bodies encode equally.
+var msgpackCodec = &codec{
+	contentType: "application/msgpack",
+	aliases:     []string{"application/x-msgpack"},
+	encode: func(w io.Writer, v interface{}) error {
+		g, err := toGeneric(v)
+		if err != nil {
+			return err
+		}
+		buf, err := appendMsgpack(nil, g)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	},
+	decode: func(r io.Reader, v interface{}) error {
+		g, err := readMsgpack(bufio.NewReader(r), 0)
+		if err != nil {
+			return err
+		}
+		return fromGeneric(g, v)
+	},
+}
+
+func appendMsgpackLen(buf []byte, n int, fix, fixMax byte, b8, b16, b32 byte) []byte {
+	switch {
+	case n <= int(fixMax):
+		return append(buf, fix|byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		return append(buf, b8, byte(n))
+	case n <= math.MaxUint16:
+		return append(append(buf, b16), byte(n>>8), byte(n))
+	}
+	return append(append(buf, b32), byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendMsgpack(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return appendMsgpackInt(buf, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, 0xcb)
+		return appendUint64(buf, math.Float64bits(f)), nil
+	case string:
+		buf = appendMsgpackLen(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		return append(buf, v...), nil
+	case []interface{}:
+		buf = appendMsgpackLen(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			var err error
+			if buf, err = appendMsgpack(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf = appendMsgpackLen(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			var err error
+			if buf, err = appendMsgpack(buf, k); err != nil {
+				return nil, err
+			}
+			if buf, err = appendMsgpack(buf, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("msgpack: cannot encode %T", v)
+}
+
+func appendMsgpackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 127:
+		return append(buf, byte(i))
+	case i < 0 && i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return append(buf, 0xd1, byte(i>>8), byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return append(buf, 0xd2, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	}
+	buf = append(buf, 0xd3)
+	return appendUint64(buf, uint64(i))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return append(buf, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxMsgpackDepth bounds the nesting of decoded bodies.
+const maxMsgpackDepth = 32
+
+var errMsgpack = errors.New("msgpack: malformed body")
+
+func readMsgpackN(r *bufio.Reader, n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func readMsgpack(r *bufio.Reader, depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errMsgpack
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return readMsgpackMap(r, int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return readMsgpackArray(r, int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return readMsgpackString(r, int(b&0x1f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		size := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[b]
+		n, err := readMsgpackN(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackString(r, int(n))
+	case 0xca:
+		n, err := readMsgpackN(r, 4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := readMsgpackN(r, 8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := readMsgpackN(r, 1<<(b-0xcc))
+		return n, err
+	case 0xd0:
+		n, err := readMsgpackN(r, 1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := readMsgpackN(r, 2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := readMsgpackN(r, 4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := readMsgpackN(r, 8)
+		return int64(n), err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackN(r, 2<<(b-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, int(n), depth)
+	case 0xde, 0xdf:
+		n, err := readMsgpackN(r, 2<<(b-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, int(n), depth)
+	}
+	return nil, errMsgpack
+}
+
+func readMsgpackString(r *bufio.Reader, n int) (interface{}, error) {
+	// Bodies are small, a length beyond what is left is malformed and must
+	// not be allocated up front.
+	buf := make([]byte, 0, minInt(n, 4096))
+	for len(buf) < n {
+		chunk := make([]byte, minInt(n-len(buf), 4096))
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		buf = append(buf, chunk...)
+	}
+	return string(buf), nil
+}
+
+func readMsgpackArray(r *bufio.Reader, n, depth int) (interface{}, error) {
+	out := make([]interface{}, 0, minInt(n, 64))
+	for i := 0; i < n; i++ {
+		v, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n, depth int) (interface{}, error) {
+	out := make(map[string]interface{}, minInt(n, 64))
+	for i := 0; i < n; i++ {
+		k, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errMsgpack
+		}
+		if out[key], err = readMsgpack(r, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,454 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiRoutes describe every route: its methods with their parameters, the
+// content types they take and answer in, and their bodies by the names of
+// schemaTypes. OPTIONS on a route answers with its Allow header and its
+// description, and /openapi.json is generated from them, so a route added
+// to routes needs its entry here.
+
+type apiParam struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+type apiMethod struct {
+	Method string `json:"method"`
+	// Head is set on GET methods that answer HEAD too.
+	Head    bool       `json:"head,omitempty"`
+	Summary string     `json:"summary"`
+	Params  []apiParam `json:"parameters,omitempty"`
+	// Accepts are the content types of the request body, Body its
+	// definition in schemaTypes.
+	Accepts []string `json:"accepts,omitempty"`
+	Body    string   `json:"body,omitempty"`
+	// Status is the status of a successful answer, 200 when zero.
+	Status   int      `json:"status,omitempty"`
+	Produces []string `json:"produces,omitempty"`
+	// Response is the definition of the answer, "[]name" for a list of
+	// them.
+	Response string `json:"response,omitempty"`
+}
+
+type apiRoute struct {
+	Path string `json:"path"`
+	// Channel routes are also served below /channels/{channel}.
+	Channel bool        `json:"-"`
+	Methods []apiMethod `json:"methods"`
+}
+
+var (
+	messageBodyTypes = []string{"application/json", "application/msgpack", "application/x-protobuf"}
+	addBodyTypes     = append(messageBodyTypes, "multipart/form-data", "application/x-www-form-urlencoded")
+	jsonOnly         = []string{"application/json"}
+	textOnly         = []string{"text/plain"}
+)
+
+var (
+	accessKeyParam = apiParam{"access_key", "query", "Access key of the channel, unless the request is signed", false}
+	adminKeyParam  = apiParam{"admin_key", "query", "Admin key", true}
+	tzParam        = apiParam{"tz", "query", "Time zone created_at is returned in, like Europe/Berlin", false}
+	fieldsParam    = apiParam{"fields", "query", "Comma separated fields of the messages to return", false}
+	pageParams     = []apiParam{
+		{"limit", "query", "Number of messages, at most -max_page_size", false},
+		{"after_id", "query", "Id of the last message of the previous page", false},
+		{"until_id", "query", "Id of the newest message to return", false},
+		{"snapshot", "query", "true pins the listing to the messages there are now", false},
+		{"all", "query", "true returns every message, deprecated", false},
+	}
+	preconditionParams = []apiParam{
+		{"If-Match", "header", "ETag the message must still have", false},
+		{"If-Unmodified-Since", "header", "Time since which the message must not have changed", false},
+	}
+	signedAdminParams = []apiParam{
+		{"X-Timestamp", "header", "Unix time of the signature in seconds", true},
+		{"X-Nonce", "header", "Random string used once", true},
+		{"X-Signature", "header", "HMAC-SHA256 of the request keyed with the admin key", true},
+	}
+)
+
+func params(lists ...[]apiParam) []apiParam {
+	var out []apiParam
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	return out
+}
+
+func one(p apiParam) []apiParam {
+	return []apiParam{p}
+}
+
+var apiRoutes = []apiRoute{
+	{Path: "/add", Channel: true, Methods: []apiMethod{
+		{Method: "POST", Summary: "Add a message", Params: one(accessKeyParam), Accepts: addBodyTypes, Body: "new_message", Produces: textOnly},
+	}},
+	{Path: "/messages", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "List messages, oldest first", Params: params(pageParams, []apiParam{
+			{"since", "query", "Earliest creation time", false},
+			{"until", "query", "Creation time the messages are older than", false},
+			{"tag", "query", "Tag the messages have", false},
+			{"wait", "query", "How long to wait for new messages when there are none, like 30s", false},
+			tzParam, fieldsParam,
+		}), Produces: messageBodyTypes, Response: "[]message"},
+	}},
+	{Path: "/messages/{id}", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Get a message", Params: []apiParam{tzParam, fieldsParam, {"render", "query", "html renders the body from Markdown", false}}, Produces: append(messageBodyTypes, "text/html"), Response: "message"},
+		{Method: "PUT", Summary: "Edit a message", Params: params(one(accessKeyParam), preconditionParams), Accepts: messageBodyTypes, Body: "new_message", Produces: textOnly},
+		{Method: "DELETE", Summary: "Delete a message with its attachments", Params: params(one(accessKeyParam), preconditionParams), Status: http.StatusNoContent},
+	}},
+	{Path: "/messages/{id}/reactions", Channel: true, Methods: []apiMethod{
+		{Method: "POST", Summary: "React to a message", Params: one(accessKeyParam), Accepts: jsonOnly, Body: "reaction", Produces: jsonOnly, Response: "reaction_counts"},
+		{Method: "DELETE", Summary: "Take back a reaction", Params: []apiParam{accessKeyParam, {"reaction", "query", "The reaction", true}, {"user", "query", "User who reacted", true}}, Produces: jsonOnly, Response: "reaction_counts"},
+	}},
+	{Path: "/messages/{id}/attachments/{name}", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Download an attachment"},
+	}},
+	{Path: "/messages/archive", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "List archived messages", Params: params(pageParams, one(tzParam)), Produces: jsonOnly, Response: "[]message"},
+	}},
+	{Path: "/messages/batch-get", Channel: true, Methods: []apiMethod{
+		{Method: "POST", Summary: "Get messages by their ids", Params: []apiParam{tzParam, fieldsParam}, Accepts: jsonOnly, Body: "batch_request", Produces: jsonOnly, Response: "batch_response"},
+	}},
+	{Path: "/messages/stats", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Count messages by day or hour", Params: []apiParam{
+			{"bucket", "query", "day or hour", false},
+			{"from", "query", "Start of the range", false},
+			{"to", "query", "End of the range", false},
+		}, Produces: jsonOnly, Response: "message_stats"},
+	}},
+	{Path: exportRoute, Channel: true, Methods: []apiMethod{
+		{Method: "GET", Summary: "Export every message as NDJSON", Params: one(tzParam), Produces: []string{"application/x-ndjson"}, Response: "message"},
+	}},
+	{Path: "/tags", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "List tags with the number of messages using them", Produces: jsonOnly, Response: "[]tag_count"},
+	}},
+	{Path: "/feed.xml", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Atom feed of the latest messages", Produces: []string{"application/atom+xml"}},
+	}},
+	{Path: "/feed.rss", Channel: true, Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "RSS feed of the latest messages", Produces: []string{"application/rss+xml"}},
+	}},
+	{Path: "/", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Version of the server", Produces: jsonOnly},
+	}},
+	{Path: "/health", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Liveness", Status: http.StatusNoContent},
+	}},
+	{Path: "/readyz", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Readiness, with the state of each check", Produces: jsonOnly},
+	}},
+	{Path: "/metrics", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Prometheus metrics", Produces: textOnly},
+	}},
+	{Path: "/schema", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "JSON Schema of the bodies", Params: one(apiParam{"type", "query", "Name of a single definition", false}), Produces: []string{"application/schema+json"}},
+	}},
+	{Path: "/openapi.json", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "OpenAPI description of the API", Produces: jsonOnly},
+	}},
+	{Path: "/admin/flagged", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "List messages held for review", Params: params(one(adminKeyParam), pageParams), Produces: jsonOnly, Response: "[]flagged_message"},
+	}},
+	{Path: "/admin/flagged/{id}/approve", Methods: []apiMethod{
+		{Method: "POST", Summary: "Publish a message held for review", Params: one(adminKeyParam), Status: http.StatusNoContent},
+	}},
+	{Path: "/admin/flagged/{id}/remove", Methods: []apiMethod{
+		{Method: "POST", Summary: "Delete a message held for review", Params: signedAdminParams, Status: http.StatusNoContent},
+	}},
+	{Path: "/admin/capture", Methods: []apiMethod{
+		{Method: "GET", Summary: "Whether body capture is on", Params: one(adminKeyParam), Produces: jsonOnly},
+		{Method: "POST", Summary: "Switch body capture", Params: []apiParam{adminKeyParam, {"enabled", "query", "true or false", true}}, Produces: jsonOnly},
+	}},
+	{Path: "/admin/usage", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Usage per channel key by day and month", Params: []apiParam{adminKeyParam, {"channel", "query", "Channel", false}, {"period", "query", "Day like 2006-01-02 or month like 2006-01", false}}, Produces: jsonOnly},
+	}},
+	{Path: "/admin/stats", Methods: []apiMethod{
+		{Method: "GET", Head: true, Summary: "Message counts and backup status", Params: one(adminKeyParam), Produces: jsonOnly},
+	}},
+	{Path: "/admin/reencrypt", Methods: []apiMethod{
+		{Method: "GET", Summary: "Progress of the last re-encryption", Params: one(adminKeyParam), Produces: jsonOnly},
+		{Method: "POST", Summary: "Re-encrypt every body with the active key", Params: signedAdminParams, Status: http.StatusAccepted, Produces: jsonOnly},
+	}},
+	{Path: chaosRoute, Methods: []apiMethod{
+		{Method: "GET", Summary: "List the fault injection rules", Params: one(adminKeyParam), Produces: jsonOnly},
+		{Method: "POST", Summary: "Replace the fault injection rules", Params: one(adminKeyParam), Accepts: jsonOnly, Produces: jsonOnly},
+		{Method: "DELETE", Summary: "Remove the fault injection rules", Params: one(adminKeyParam), Produces: jsonOnly},
+	}},
+	{Path: "/admin/features", Methods: []apiMethod{
+		{Method: "GET", Summary: "List the feature flags and their rollouts", Params: one(adminKeyParam), Produces: jsonOnly},
+		{Method: "POST", Summary: "Change rollouts", Params: one(adminKeyParam), Accepts: jsonOnly, Produces: jsonOnly},
+		{Method: "DELETE", Summary: "Reset the rollouts to -features", Params: one(adminKeyParam), Produces: jsonOnly},
+	}},
+	{Path: "/admin/messages", Methods: []apiMethod{
+		{Method: "DELETE", Summary: "Start a job purging messages", Params: params(signedAdminParams, []apiParam{
+			{"before", "query", "Time the messages are older than", false},
+			{"tag", "query", "Tag the messages have", false},
+			{"channel", "query", "Channel of the messages", false},
+		}), Status: http.StatusAccepted, Produces: jsonOnly},
+	}},
+	{Path: "/admin/jobs", Methods: []apiMethod{
+		{Method: "GET", Summary: "List the recent jobs", Params: one(adminKeyParam), Produces: jsonOnly},
+	}},
+	{Path: "/admin/jobs/{id}", Methods: []apiMethod{
+		{Method: "GET", Summary: "Progress of a job", Params: one(adminKeyParam), Produces: jsonOnly},
+		{Method: "DELETE", Summary: "Cancel a job", Params: one(adminKeyParam), Produces: jsonOnly},
+	}},
+}
+
+// allowed reports whether rt answers method, which OPTIONS always is.
+func (rt apiRoute) allowed(method string) bool {
+	for _, m := range rt.Methods {
+		if m.Method == method || (m.Head && method == "HEAD") {
+			return true
+		}
+	}
+	return method == "OPTIONS"
+}
+
+// allow is the Allow header of rt.
+func (rt apiRoute) allow() string {
+	var methods []string
+	for _, m := range rt.Methods {
+		methods = append(methods, m.Method)
+		if m.Head {
+			methods = append(methods, "HEAD")
+		}
+	}
+	return strings.Join(append(methods, "OPTIONS"), ", ")
+}
+
+// notAllowed is the error answering the methods rt does not, worded like
+// the ones of the handlers so it is translated the same.
+func (rt apiRoute) notAllowed() string {
+	methods := make([]string, len(rt.Methods))
+	for i, m := range rt.Methods {
+		methods[i] = m.Method
+	}
+	if len(methods) == 1 {
+		return "Only " + methods[0] + " method is allowed!"
+	}
+	return "Only " + strings.Join(methods[:len(methods)-1], ", ") + " and " + methods[len(methods)-1] + " methods are allowed!"
+}
+
+// pathParamDescriptions describe the {name} segments of the paths.
+var pathParamDescriptions = map[string]string{
+	"id":   "Id of the message or job",
+	"name": "File name of the attachment",
+}
+
+// pathParams are the {name} segments of the path of rt.
+func (rt apiRoute) pathParams() []apiParam {
+	var out []apiParam
+	for _, seg := range strings.Split(rt.Path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			name := seg[1 : len(seg)-1]
+			out = append(out, apiParam{Name: name, In: "path", Description: pathParamDescriptions[name], Required: true})
+		}
+	}
+	return out
+}
+
+func (rt apiRoute) matches(path string) bool {
+	want := strings.Split(rt.Path, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i, seg := range want {
+		if strings.HasPrefix(seg, "{") {
+			if got[i] == "" {
+				return false
+			}
+		} else if seg != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// routeFor finds the route serving path, below /channels/{name} only the
+// channel routes. The patterns are tried before those with parameters, so
+// /messages/stats is not taken for /messages/{id}.
+func routeFor(path string) (apiRoute, bool) {
+	channel := false
+	if strings.HasPrefix(path, "/channels/") {
+		rest := strings.TrimPrefix(path, "/channels/")
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			return apiRoute{}, false
+		}
+		if _, ok := channels[rest[:i]]; !ok || rest[:i] == defaultChannel {
+			return apiRoute{}, false
+		}
+		path, channel = rest[i:], true
+	}
+	var found *apiRoute
+	for i := range apiRoutes {
+		rt := &apiRoutes[i]
+		if (channel && !rt.Channel) || !rt.matches(path) {
+			continue
+		}
+		if found == nil || strings.Count(found.Path, "{") > strings.Count(rt.Path, "{") {
+			found = rt
+		}
+	}
+	if found == nil {
+		return apiRoute{}, false
+	}
+	return *found, true
+}
+
+// describing answers OPTIONS on every route with its Allow header and
+// description, and the methods a route does not take with a 405 carrying
+// the same Allow header. The rest is handed to next.
+func describing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rt, ok := routeFor(r.URL.Path)
+		if !ok {
+			if r.Method == "OPTIONS" {
+				http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if !rt.allowed(r.Method) {
+			rw.Header().Set("Allow", rt.allow())
+			http.Error(rw, rt.notAllowed(), http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method != "OPTIONS" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		desc := struct {
+			apiRoute
+			PathParams []apiParam `json:"path_parameters,omitempty"`
+		}{rt, rt.pathParams()}
+		rw.Header().Set("Allow", rt.allow())
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(desc)
+	})
+}
+
+// openAPI builds the OpenAPI 3.1 document of apiRoutes, with the
+// definitions of /schema as its component schemas.
+func openAPI() map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, rt := range apiRoutes {
+		paths[rt.Path] = pathItem(rt, nil)
+		if rt.Channel {
+			paths["/channels/{channel}"+rt.Path] = pathItem(rt, []apiParam{{Name: "channel", In: "path", Description: "Channel configured with -channels", Required: true}})
+		}
+	}
+	defs := rebaseRefs(jsonSchema()["$defs"], "#/$defs/", "#/components/schemas/")
+	server := base_path
+	if server == "" {
+		server = "/"
+	}
+	return map[string]interface{}{
+		"openapi":           "3.1.0",
+		"jsonSchemaDialect": "https://json-schema.org/draft/2020-12/schema",
+		"info":              map[string]interface{}{"title": "simple-http-server-go", "version": "v1.0.0"},
+		"servers":           []interface{}{map[string]interface{}{"url": server}},
+		"paths":             paths,
+		"components":        map[string]interface{}{"schemas": defs},
+	}
+}
+
+func pathItem(rt apiRoute, prefix []apiParam) map[string]interface{} {
+	item := map[string]interface{}{}
+	for _, m := range rt.Methods {
+		var parameters []interface{}
+		for _, p := range params(prefix, rt.pathParams(), m.Params) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Description,
+				"required":    p.Required,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		op := map[string]interface{}{"summary": m.Summary}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+		if len(m.Accepts) > 0 {
+			op["requestBody"] = map[string]interface{}{"required": true, "content": content(m.Accepts, m.Body)}
+		}
+		status := m.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		if len(m.Produces) > 0 {
+			response["content"] = content(m.Produces, m.Response)
+		}
+		op["responses"] = map[string]interface{}{strconv.Itoa(status): response}
+		item[strings.ToLower(m.Method)] = op
+	}
+	return item
+}
+
+// content maps each of types to the schema of the definition name, or to
+// no schema when there is none.
+func content(types []string, name string) map[string]interface{} {
+	schema := map[string]interface{}{}
+	if name != "" {
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + strings.TrimPrefix(name, "[]")}
+		schema = ref
+		if strings.HasPrefix(name, "[]") {
+			schema = map[string]interface{}{"type": "array", "items": ref}
+		}
+	}
+	out := map[string]interface{}{}
+	for _, t := range types {
+		out[t] = map[string]interface{}{"schema": schema}
+	}
+	return out
+}
+
+// rebaseRefs returns v with the $ref values starting with from moved to to.
+func rebaseRefs(v interface{}, from, to string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if s, ok := e.(string); ok && k == "$ref" && strings.HasPrefix(s, from) {
+				e = to + strings.TrimPrefix(s, from)
+			}
+			out[k] = rebaseRefs(e, from, to)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = rebaseRefs(e, from, to)
+		}
+		return out
+	}
+	return v
+}
+
+// openAPIDocument serves /openapi.json.
+func openAPIDocument() http.Handler {
+	doc, _ := json.Marshal(openAPI())
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, "Only GET method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(doc)
+	})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Calls to other services, the moderation service, S3 and the readiness
+// probes, share one pool of connections. They carry the X-Request-Id, a
+// traceparent and the X-Request-Deadline of the request they are made for,
+// and are retried on network errors and 502, 503 and 504 answers when their
+// body can be sent again.
+
+var (
+	outboundRequests = newCounter("http_client_requests_total", "Attempts of calls to other services, by target and status code, error when there was no answer.", "target", "code")
+	outboundRetries  = newCounter("http_client_retries_total", "Calls to other services retried, by target.", "target")
+	outboundDuration = newHistogram("http_client_request_duration_seconds", "Time taken by each attempt of a call to another service, by target.", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "target")
+)
+
+var (
+	sharedTransport     *http.Transport
+	sharedTransportOnce sync.Once
+)
+
+func outboundTransport() *http.Transport {
+	sharedTransportOnce.Do(func() {
+		sharedTransport = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: outbound_dial_timeout, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   outbound_max_idle_per_host,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   outbound_dial_timeout,
+			ResponseHeaderTimeout: outbound_response_timeout,
+			ExpectContinueTimeout: time.Second,
+		}
+	})
+	return sharedTransport
+}
+
+// newHTTPClient returns a client for calls to target, named in the metrics,
+// each taking at most timeout including retries, 0 for no limit but that of
+// their context.
+func newHTTPClient(target string, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &instrumentedTransport{target: target}, Timeout: timeout}
+}
+
+type instrumentedTransport struct {
+	target string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	out := req.Clone(ctx)
+	if requestID, ok := ctx.Value(requestIDKey).(string); ok {
+		out.Header.Set("X-Request-Id", requestID)
+	}
+	out.Header.Set("Traceparent", traceparentOf(ctx))
+	if deadline, ok := ctx.Deadline(); ok {
+		out.Header.Set("X-Request-Deadline", deadline.UTC().Format(time.RFC3339Nano))
+	}
+	backoff := outbound_retry_backoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := outboundTransport().RoundTrip(out)
+		outboundDuration.observe(time.Since(start).Seconds(), t.target)
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		outboundRequests.inc(t.target, code)
+		retryable := err != nil || resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		if !retryable || attempt >= outbound_retries || (out.Body != nil && out.GetBody == nil) || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if out.GetBody != nil {
+			if out.Body, err = out.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		outboundRetries.inc(t.target)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(mathrand.Int63n(int64(backoff) + 1))):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// A trace is the W3C trace context of a request: the trace it is part of,
+// continued from its traceparent header or started for it, and the flags.
+type trace struct {
+	id, flags string
+}
+
+// parseTraceparent reads a version 00 traceparent header.
+func parseTraceparent(header string) (trace, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return trace{}, false
+	}
+	for _, p := range parts[1:] {
+		if _, err := hex.DecodeString(p); err != nil {
+			return trace{}, false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return trace{}, false
+	}
+	return trace{id: parts[1], flags: parts[3]}, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceparentOf is the traceparent of a call made for the request ctx
+// belongs to, in its trace with a new parent id. Calls made in the
+// background start a trace of their own.
+func traceparentOf(ctx context.Context) string {
+	t, ok := ctx.Value(traceKey).(trace)
+	if !ok {
+		t = trace{id: randomHex(16), flags: "01"}
+	}
+	return "00-" + t.id + "-" + randomHex(8) + "-" + t.flags
+}
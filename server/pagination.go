@@ -0,0 +1,93 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// page is a keyset page of a listing: rows with an id greater than AfterID,
+// at most Limit of them. Limit is 0 when the client asked for everything.
+// UntilID, when set, pins the listing to the rows that existed when paging
+// started, so messages added meanwhile do not show up halfway through.
+type page struct {
+	AfterID int64
+	Limit   int
+	UntilID int64
+}
+
+func parsePage(r *http.Request) (page, error) {
+	q := r.URL.Query()
+	p := page{Limit: page_size}
+	if v := q.Get("after_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 0 {
+			return p, fmt.Errorf("after_id must be a message id!")
+		}
+		p.AfterID = id
+	}
+	if v := q.Get("until_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			return p, fmt.Errorf("until_id must be a message id!")
+		}
+		p.UntilID = id
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > max_page_size {
+			return p, fmt.Errorf("limit must be between 1 and %d!", max_page_size)
+		}
+		p.Limit = limit
+	}
+	if q.Get("all") == "true" {
+		p.Limit = 0
+	}
+	return p, nil
+}
+
+// pinSnapshot sets the UntilID of a listing of table asking for
+// ?snapshot=true to the newest id of the channel, unless it already has one.
+func pinSnapshot(r *http.Request, db *sql.DB, table string, p *page) error {
+	if p.UntilID != 0 || r.URL.Query().Get("snapshot") != "true" {
+		return nil
+	}
+	return withRetry(r.Context(), "pin_snapshot", func() error {
+		return db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM "+table+" WHERE channel = ?", channelOf(r).name).Scan(&p.UntilID)
+	})
+}
+
+// nextPageLink returns a Link header value pointing at the page following the
+// one ending at lastID, keeping every other query parameter of the request.
+// A pinned snapshot is carried over as until_id.
+func nextPageLink(r *http.Request, lastID string, p page) string {
+	return fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r, lastID, p))
+}
+
+// nextPageURL is the URL of the page after the one ending with lastID.
+func nextPageURL(r *http.Request, lastID string, p page) string {
+	q := r.URL.Query()
+	q.Set("after_id", lastID)
+	q.Set("limit", strconv.Itoa(p.Limit))
+	if p.UntilID != 0 {
+		q.Del("snapshot")
+		q.Set("until_id", strconv.FormatInt(p.UntilID, 10))
+	}
+	next := url.URL{Path: channelOf(r).prefix() + r.URL.Path, RawQuery: q.Encode()}
+	return next.String()
+}
+
+// deprecateAll marks a response to ?all=true as deprecated. Unpaginated
+// listings are kept only until clients have moved to limit/after_id.
+func deprecateAll(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Deprecation", "true")
+	if all_sunset != "" {
+		rw.Header().Set("Sunset", all_sunset)
+	}
+	rw.Header().Set("Warning", `299 - "all=true is deprecated, page with limit and after_id instead"`)
+	requestID := requestIDOf(r.Context())
+	log.Println(requestID, "deprecated all=true listing requested by", r.RemoteAddr, r.UserAgent())
+}
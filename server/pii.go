@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var piiRedactions = newCounter("pii_redactions_total", "Personal data replaced in message bodies before storage, by kind.", "kind")
+
+// A piiPattern finds one kind of personal data. valid, when set, weeds out
+// matches that only look like it.
+type piiPattern struct {
+	kind    string
+	pattern *regexp.Regexp
+	valid   func(match string) bool
+}
+
+// builtinPII are the kinds -redact_pii can name. Card numbers come before
+// phone numbers, which would match them too.
+var builtinPII = []piiPattern{
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), nil},
+	{"card", regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), luhn},
+	{"phone", regexp.MustCompile(`(?:\+|\b)\d[\d ().-]{6,}\d\b`), phoneDigits},
+}
+
+var piiPatterns []piiPattern
+
+// newPIIPatterns puts the patterns of -redact_patterns_file first, they are
+// usually narrower than the built in ones.
+func newPIIPatterns() ([]piiPattern, error) {
+	var out []piiPattern
+	if redact_patterns_file != "" {
+		custom, err := readPIIPatterns(redact_patterns_file)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, custom...)
+	}
+	kinds := map[string]bool{}
+	for _, kind := range splitList(redact_pii) {
+		found := false
+		for _, p := range builtinPII {
+			found = found || p.kind == kind
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown kind %q in -redact_pii, use email, phone or card", kind)
+		}
+		kinds[kind] = true
+	}
+	// The built in patterns keep their order whatever the order of
+	// -redact_pii.
+	for _, p := range builtinPII {
+		if kinds[p.kind] {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// readPIIPatterns reads one kind=regexp per line, skipping blank lines and
+// # comments.
+func readPIIPatterns(path string) ([]piiPattern, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []piiPattern
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("%s:%d: use kind=regexp", path, n)
+		}
+		pattern, err := regexp.Compile(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		out = append(out, piiPattern{kind: line[:i], pattern: pattern})
+	}
+	return out, scanner.Err()
+}
+
+func digitsOf(s string) []int {
+	var out []int
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			out = append(out, int(r-'0'))
+		}
+	}
+	return out
+}
+
+// luhn checks the check digit of a card number.
+func luhn(s string) bool {
+	digits := digitsOf(s)
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// phoneDigits keeps matches with as many digits as phone numbers have.
+func phoneDigits(s string) bool {
+	n := len(digitsOf(s))
+	return n >= 8 && n <= 15
+}
+
+// redactPII replaces the personal data in text with [kind] and counts the
+// replacements by kind.
+func redactPII(text string) (string, map[string]int) {
+	counts := map[string]int{}
+	for _, p := range piiPatterns {
+		text = p.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if p.valid != nil && !p.valid(match) {
+				return match
+			}
+			counts[p.kind]++
+			return "[" + p.kind + "]"
+		})
+	}
+	for kind, n := range counts {
+		piiRedactions.add(float64(n), kind)
+	}
+	return text, counts
+}
+
+// setRedactedHeader reports what was redacted, like X-Redacted: email=1, phone=2.
+func setRedactedHeader(rw http.ResponseWriter, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	parts := make([]string, 0, len(counts))
+	for kind, n := range counts {
+		parts = append(parts, fmt.Sprintf("%s=%d", kind, n))
+	}
+	sort.Strings(parts)
+	rw.Header().Set("X-Redacted", strings.Join(parts, ", "))
+}
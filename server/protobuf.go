@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// protobufCodec encodes messages and listings as the protobuf messages below
+// and reads new messages from a Message. Other bodies have no protobuf form.
+//
+//	message Attachment {
+//	  string name = 1;
+//	  string content_type = 2;
+//	  int64 size = 3;
+//	  string url = 4;
+//	}
+//	message Message {
+//	  string id = 1;
+//	  string message = 2;
+//	  string created_at = 3; // RFC 3339
+//	  repeated string tags = 4;
+//	  map<string, int64> reactions = 5;
+//	  repeated Attachment attachments = 6;
+//	}
+//	message MessageList {
+//	  repeated Message messages = 1;
+//	}
+var protobufCodec = &codec{
+	contentType: "application/x-protobuf",
+	aliases:     []string{"application/protobuf"},
+	encode: func(w io.Writer, v interface{}) error {
+		var buf []byte
+		switch v := v.(type) {
+		case messageType:
+			buf = appendProtoMessage(nil, v)
+		case []messageType:
+			for _, msg := range v {
+				buf = appendProtoBytes(buf, 1, appendProtoMessage(nil, msg))
+			}
+		default:
+			return errUnsupportedBody
+		}
+		_, err := w.Write(buf)
+		return err
+	},
+	decode: func(r io.Reader, v interface{}) error {
+		msg, ok := v.(*messageInput)
+		if !ok {
+			return errUnsupportedBody
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return readProtoMessage(b, msg)
+	},
+}
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendProtoBytes(buf []byte, field int, b []byte) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|protoBytes)
+	buf = appendVarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// appendProtoString leaves out empty strings like proto3 does.
+func appendProtoString(buf []byte, field int, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	return appendProtoBytes(buf, field, []byte(s))
+}
+
+func appendProtoInt(buf []byte, field int, v int64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendVarint(buf, uint64(field)<<3|protoVarint)
+	return appendVarint(buf, uint64(v))
+}
+
+func appendProtoMessage(buf []byte, msg messageType) []byte {
+	buf = appendProtoString(buf, 1, msg.Id)
+	buf = appendProtoString(buf, 2, msg.Message)
+	// Left out of ?fields= the time is zero, and empty like other fields.
+	if !msg.Timestamp.IsZero() {
+		buf = appendProtoString(buf, 3, msg.Timestamp.Format(time.RFC3339))
+	}
+	for _, tag := range msg.Tags {
+		buf = appendProtoBytes(buf, 4, []byte(tag))
+	}
+	reactions := make([]string, 0, len(msg.Reactions))
+	for r := range msg.Reactions {
+		reactions = append(reactions, r)
+	}
+	sort.Strings(reactions)
+	for _, r := range reactions {
+		entry := appendProtoString(nil, 1, r)
+		entry = appendProtoInt(entry, 2, int64(msg.Reactions[r]))
+		buf = appendProtoBytes(buf, 5, entry)
+	}
+	for _, a := range msg.Attachments {
+		att := appendProtoString(nil, 1, a.Name)
+		att = appendProtoString(att, 2, a.ContentType)
+		att = appendProtoInt(att, 3, a.Size)
+		att = appendProtoString(att, 4, a.URL)
+		buf = appendProtoBytes(buf, 6, att)
+	}
+	return buf
+}
+
+var errProtobuf = errors.New("protobuf: malformed body")
+
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// readProtoMessage reads the message and tags of a new message, the fields
+// a client may set. Unknown fields are skipped.
+func readProtoMessage(b []byte, msg *messageInput) error {
+	for len(b) > 0 {
+		key, n := readVarint(b)
+		if n == 0 {
+			return errProtobuf
+		}
+		b = b[n:]
+		field, wireType := key>>3, key&7
+		var value []byte
+		switch wireType {
+		case protoVarint:
+			if _, n = readVarint(b); n == 0 {
+				return errProtobuf
+			}
+		case protoFixed64:
+			n = 8
+		case protoFixed32:
+			n = 4
+		case protoBytes:
+			size, m := readVarint(b)
+			if m == 0 || size > uint64(len(b)-m) {
+				return errProtobuf
+			}
+			value = b[m : m+int(size)]
+			n = m + int(size)
+		default:
+			return errProtobuf
+		}
+		if n > len(b) {
+			return errProtobuf
+		}
+		b = b[n:]
+		if wireType != protoBytes {
+			continue
+		}
+		switch field {
+		case 2:
+			msg.Message = string(value)
+		case 4:
+			msg.Tags = append(msg.Tags, string(value))
+		}
+	}
+	return nil
+}
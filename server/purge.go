@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// purgeFilter selects the messages DELETE /admin/messages removes.
+type purgeFilter struct {
+	before  time.Time
+	tag     string
+	channel string
+}
+
+func (f purgeFilter) params() map[string]string {
+	out := map[string]string{}
+	if !f.before.IsZero() {
+		out["before"] = f.before.Format(time.RFC3339)
+	}
+	if f.tag != "" {
+		out["tag"] = f.tag
+	}
+	if f.channel != "" {
+		out["channel"] = f.channel
+	}
+	return out
+}
+
+// purgeMessages serves DELETE /admin/messages: it starts a job deleting the
+// messages older than ?before=, with ?tag=, in ?channel=, or matching all of
+// them, and answers 202 with the job. The messages go in batches of
+// -archive_batch, each its own transaction, so the table is never locked
+// for long.
+func purgeMessages(ctx context.Context, logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			rw.Header().Set("Allow", "DELETE")
+			http.Error(rw, "Only DELETE method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		if !adminSigned(rw, r) {
+			return
+		}
+		q := r.URL.Query()
+		f := purgeFilter{tag: q.Get("tag"), channel: q.Get("channel")}
+		if before := q.Get("before"); before != "" {
+			var err error
+			if f.before, err = parseTime(before); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if f.before.IsZero() && f.tag == "" {
+			http.Error(rw, "before or tag is required!", http.StatusBadRequest)
+			return
+		}
+		db, err := initDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		j := startJob(ctx, logger, "purge", f.params(), func(ctx context.Context, j *job) error {
+			for {
+				var n int
+				var keys []string
+				err := withRetry(ctx, "purge_batch", func() (err error) {
+					n, keys, err = purgeBatch(ctx, db, f)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				deleteBlobs(ctx, keys)
+				j.progress(n)
+				if n < archive_batch {
+					return nil
+				}
+			}
+		})
+		rw.Header().Set("Location", base_path+"/admin/jobs/"+j.ID)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(rw).Encode(j)
+	})
+}
+
+// purgeBatch deletes up to -archive_batch messages matching f with their
+// tags, reactions and attachments, and returns how many it deleted and the
+// blobs of their attachments.
+func purgeBatch(ctx context.Context, db *sql.DB, f purgeFilter) (int, []string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	query := "SELECT m.id FROM messages m"
+	var args []interface{}
+	if f.tag != "" {
+		query += " JOIN message_tags mt ON mt.message_id = m.id JOIN tags t ON t.id = mt.tag_id AND t.name = ?"
+		args = append(args, f.tag)
+	}
+	query += " WHERE 1 = 1"
+	if !f.before.IsZero() {
+		query += " AND m.timestamp < ?"
+		args = append(args, f.before)
+	}
+	if f.channel != "" {
+		query += " AND m.channel = ?"
+		args = append(args, f.channel)
+	}
+	rows, err := tx.Query(query+" ORDER BY m.id LIMIT ? FOR UPDATE", append(args, archive_batch)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	for _, id := range ids {
+		if err := recordEvent(tx, eventDeleted, id.(int64)); err != nil {
+			return 0, nil, err
+		}
+	}
+	in := "(" + placeholders(len(ids)) + ")"
+	rows, err = tx.Query("SELECT blob_key FROM attachments WHERE message_id IN "+in, ids...)
+	if err != nil {
+		return 0, nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	for _, table := range []string{"messages", "message_tags", "reactions", "attachments"} {
+		column := "message_id"
+		if table == "messages" {
+			column = "id"
+		}
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE "+column+" IN "+in, ids...); err != nil {
+			return 0, nil, err
+		}
+	}
+	return len(ids), keys, commit(tx)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxReactionLength     = 16
+	maxReactionUserLength = 64
+)
+
+type reactionType struct {
+	Reaction string `json:"reaction"`
+	User     string `json:"user"`
+}
+
+type reactionCounts struct {
+	MessageId string         `json:"message_id"`
+	Reactions map[string]int `json:"reactions"`
+}
+
+func validReaction(reaction reactionType) bool {
+	if reaction.Reaction == "" || utf8.RuneCountInString(reaction.Reaction) > maxReactionLength {
+		return false
+	}
+	for _, c := range reaction.Reaction {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return false
+		}
+	}
+	user := strings.TrimSpace(reaction.User)
+	return user != "" && user == reaction.User && utf8.RuneCountInString(user) <= maxReactionUserLength
+}
+
+// reactions handles POST and DELETE of /messages/{id}/reactions. Every
+// reaction is its own row and counts are aggregated when read, so concurrent
+// reactions never race on a shared counter. The primary key makes a user's
+// reaction unique per message; reacting twice is a no-op.
+func reactions(messageID int64) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "DELETE" {
+			rw.Header().Set("Allow", "POST, DELETE")
+			http.Error(rw, "Only POST and DELETE methods are allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		// Signed requests are verified over the body, so authorize before
+		// reading it.
+		if !authorized(rw, r) {
+			return
+		}
+		var reaction reactionType
+		if r.Method == "POST" {
+			if err := decodeJSON(r.Body, &reaction); err != nil {
+				bodyError(rw, err)
+				return
+			}
+		} else {
+			reaction.Reaction = r.URL.Query().Get("reaction")
+			reaction.User = r.URL.Query().Get("user")
+		}
+		if !validReaction(reaction) {
+			http.Error(rw, "A reaction and user are required! Reactions are at most 16 characters without spaces.", http.StatusBadRequest)
+			return
+		}
+		db, err := initDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+
+		channel := channelOf(r).name
+		status := http.StatusOK
+		if r.Method == "POST" {
+			// Selecting from messages checks the message exists in the same
+			// statement that inserts the reaction.
+			var res sql.Result
+			err := withRetry(r.Context(), "add_reaction", func() (err error) {
+				res, err = db.Exec("INSERT INTO reactions(message_id, reaction, user) SELECT id, ?, ? FROM messages WHERE id = ? AND channel = ? ON DUPLICATE KEY UPDATE message_id = message_id", reaction.Reaction, reaction.User, messageID, channel)
+				return err
+			})
+			if err != nil {
+				log.Println(err)
+				storeError(rw, err, "Unable to add reaction")
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 1 {
+				status = http.StatusCreated
+			} else if exists, err := messageExists(db, channel, messageID); err != nil {
+				storeError(rw, err, "Unable to add reaction")
+				return
+			} else if !exists {
+				http.Error(rw, "Message not found", http.StatusNotFound)
+				return
+			}
+		} else {
+			if exists, err := messageExists(db, channel, messageID); err != nil {
+				storeError(rw, err, "Unable to remove reaction")
+				return
+			} else if !exists {
+				http.Error(rw, "Message not found", http.StatusNotFound)
+				return
+			}
+			var res sql.Result
+			err := withRetry(r.Context(), "remove_reaction", func() (err error) {
+				res, err = db.Exec("DELETE FROM reactions WHERE message_id = ? AND reaction = ? AND user = ?", messageID, reaction.Reaction, reaction.User)
+				return err
+			})
+			if err != nil {
+				log.Println(err)
+				storeError(rw, err, "Unable to remove reaction")
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(rw, "Reaction not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		msgs := []messageType{{Id: formatID(messageID)}}
+		if err := timed(r.Context(), "load_reactions", func() error { return loadReactions(r.Context(), db, msgs) }); err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to get reactions from db", http.StatusInternalServerError)
+			return
+		}
+		counts := reactionCounts{MessageId: msgs[0].Id, Reactions: msgs[0].Reactions}
+		if counts.Reactions == nil {
+			counts.Reactions = map[string]int{}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(counts)
+	})
+}
+
+func messageExists(db *sql.DB, channel string, messageID int64) (bool, error) {
+	var one int
+	err := db.QueryRow("SELECT 1 FROM messages WHERE id = ? AND channel = ?", messageID, channel).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// loadReactions fills in the reaction counts of a page of messages.
+func loadReactions(ctx context.Context, db queryer, msgs []messageType) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	byID := make(map[string]*messageType, len(msgs))
+	ids := make([]interface{}, len(msgs))
+	for i := range msgs {
+		byID[msgs[i].Id] = &msgs[i]
+		ids[i] = msgs[i].Id
+	}
+	// Unpaginated listings can be large, keep the IN lists bounded.
+	for start := 0; start < len(ids); start += 500 {
+		end := start + 500
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+		qctx, cancel := queryDeadline(ctx)
+		rows, err := db.QueryContext(qctx, "SELECT message_id, reaction, COUNT(*) FROM reactions WHERE message_id IN ("+placeholders(len(chunk))+") GROUP BY message_id, reaction", chunk...)
+		if err != nil {
+			cancel()
+			return err
+		}
+		for rows.Next() {
+			var id, reaction string
+			var count int
+			if err := rows.Scan(&id, &reaction, &count); err != nil {
+				rows.Close()
+				cancel()
+				return err
+			}
+			if msg := byID[id]; msg != nil {
+				if msg.Reactions == nil {
+					msg.Reactions = make(map[string]int)
+				}
+				msg.Reactions[reaction] = count
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// /readyz runs the dependency checks of -readyz_checks at once, each with
+// its own timeout, and fails when one of them does. Their last results are
+// also served as metrics.
+
+// readinessChecks are the checks -readyz_checks can name. A check of a
+// dependency that is not configured is refused by configure.
+var readinessChecks = map[string]struct {
+	configured func() bool
+	check      func(ctx context.Context) error
+}{
+	"mysql": {func() bool { return true }, func(ctx context.Context) error {
+		primary, _ := currentPools()
+		if primary == nil {
+			return errors.New("not connected")
+		}
+		return primary.PingContext(ctx)
+	}},
+	"mysql_replica": {func() bool { return mysql_read_dsn != "" }, func(ctx context.Context) error {
+		_, replica := currentPools()
+		if replica == nil {
+			return errors.New("not connected")
+		}
+		return replica.PingContext(ctx)
+	}},
+	"redis": {func() bool { return redis_addr != "" }, func(ctx context.Context) error {
+		_, err := rdb.do(ctx, "PING")
+		return err
+	}},
+	"blob_store": {func() bool { return true }, func(ctx context.Context) error {
+		// A blob that does not exist tells the store answers.
+		rc, err := blobs.Get(ctx, "readyz/probe")
+		if err == errBlobNotFound {
+			return nil
+		}
+		if err == nil {
+			rc.Close()
+		}
+		return err
+	}},
+	"moderation": {func() bool { return moderation_url != "" }, func(ctx context.Context) error {
+		return probeURL(ctx, moderation_url)
+	}},
+	"events": {func() bool { return events_url != "" }, func(ctx context.Context) error {
+		conn, err := dialNATS(ctx, currentSecret("events_url"))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}},
+}
+
+type readinessCheck struct {
+	name    string
+	timeout time.Duration
+}
+
+var readyzChecks []readinessCheck
+
+// parseReadinessChecks parses -readyz_checks, a comma separated list of
+// check names, each optionally with =timeout.
+func parseReadinessChecks(spec string) ([]readinessCheck, error) {
+	var out []readinessCheck
+	for _, entry := range splitList(spec) {
+		c := readinessCheck{name: entry, timeout: readyz_check_timeout}
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			d, err := time.ParseDuration(entry[i+1:])
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("readiness check %q is not a valid duration", entry)
+			}
+			c.name, c.timeout = entry[:i], d
+		}
+		known, ok := readinessChecks[c.name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown readiness check %q", c.name)
+		}
+		if !known.configured() {
+			return nil, fmt.Errorf("Readiness check %q needs its dependency configured", c.name)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+var probeClient = newHTTPClient("readyz", 0)
+
+// probeURL checks that a service answers at all, a 5xx is a failure.
+func probeURL(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	return nil
+}
+
+type checkResult struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// lastChecks are the results of the latest /readyz, for the metrics.
+var lastChecks = struct {
+	sync.Mutex
+	results map[string]checkResult
+}{results: map[string]checkResult{}}
+
+func init() {
+	newGaugeFunc("readyz_check_up", "Whether the dependency check passed at the latest /readyz, by check.", []string{"check"}, func() []sample {
+		return checkSamples(func(r checkResult) float64 {
+			if r.Status == "ok" {
+				return 1
+			}
+			return 0
+		})
+	})
+	newGaugeFunc("readyz_check_duration_seconds", "How long the dependency check took at the latest /readyz, by check.", []string{"check"}, func() []sample {
+		return checkSamples(func(r checkResult) float64 { return r.Latency / 1000 })
+	})
+}
+
+func checkSamples(value func(checkResult) float64) []sample {
+	lastChecks.Lock()
+	defer lastChecks.Unlock()
+	out := make([]sample, 0, len(lastChecks.results))
+	for name, r := range lastChecks.results {
+		out = append(out, sample{labels: []string{name}, value: value(r)})
+	}
+	return out
+}
+
+// runChecks runs the checks concurrently and waits for all of them.
+func runChecks(ctx context.Context, checks []readinessCheck) map[string]checkResult {
+	results := make(map[string]checkResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+			start := time.Now()
+			err := readinessChecks[c.name].check(cctx)
+			r := checkResult{Status: "ok", Latency: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				r.Status, r.Error = "fail", err.Error()
+			}
+			mu.Lock()
+			results[c.name] = r
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// readyz tells load balancers whether to send traffic. Unlike /health it
+// fails while -wait_for_db is still waiting for the database, and when one
+// of the dependency checks fails.
+func readyz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := readinessReport{Status: "ok", Checks: map[string]checkResult{}}
+		switch {
+		case atomic.LoadInt32(&healthy) == 0:
+			report.Status = "unavailable"
+		case atomic.LoadInt32(&ready) == 0:
+			report.Status = "starting"
+		default:
+			report.Checks = runChecks(r.Context(), readyzChecks)
+			lastChecks.Lock()
+			for name, result := range report.Checks {
+				lastChecks.results[name] = result
+			}
+			lastChecks.Unlock()
+			for _, result := range report.Checks {
+				if result.Status != "ok" {
+					report.Status = "fail"
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -redis_addr the state replicas behind a load balancer should agree
+// on is kept in Redis: the /messages/stats cache and the usage counters the
+// quotas are checked against. Redis failing falls back to the local cache
+// and to counting in the database, so an outage costs sharing, not
+// requests.
+
+var redisErrors = newCounter("redis_errors_total", "Redis commands that failed, by command.", "command")
+
+// rdb is the Redis client, nil without -redis_addr.
+var rdb *redisClient
+
+// redisIdleConns is how many connections are kept open between commands.
+const redisIdleConns = 16
+
+// redisError is an error reply of the server, the connection is still
+// usable after it.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient speaks RESP to a single Redis server over a small pool of
+// connections.
+type redisClient struct {
+	addr    string
+	db      int
+	timeout time.Duration
+	idle    chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRedisClient() *redisClient {
+	return &redisClient{
+		addr:    redis_addr,
+		db:      redis_db,
+		timeout: redis_timeout,
+		idle:    make(chan *redisConn, redisIdleConns),
+	}
+}
+
+func (c *redisClient) key(parts ...string) string {
+	return redis_prefix + strings.Join(parts, ":")
+}
+
+// conn returns an idle connection, or a new one when there is none or
+// fresh is set.
+func (c *redisClient) conn(ctx context.Context, fresh bool) (*redisConn, bool, error) {
+	if !fresh {
+		select {
+		case conn := <-c.idle:
+			return conn, true, nil
+		default:
+		}
+	}
+	d := net.Dialer{Timeout: c.timeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	var setup [][]string
+	// The password is looked up for every connection, so a reloaded one is
+	// used from the next.
+	if password := currentSecret("redis_password"); password != "" {
+		setup = append(setup, []string{"AUTH", password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.roundTrip(ctx, conn, setup); err != nil {
+			nc.Close()
+			return nil, false, err
+		}
+	}
+	return conn, false, nil
+}
+
+func (c *redisClient) release(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// roundTrip writes the commands at once and reads their replies. The first
+// error reply is returned after all replies are read.
+func (c *redisClient) roundTrip(ctx context.Context, conn *redisConn, cmds [][]string) ([]interface{}, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	for _, cmd := range cmds {
+		fmt.Fprintf(conn.w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(conn.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		reply, err := readReply(conn.r)
+		if e, ok := err.(redisError); ok {
+			if replyErr == nil {
+				replyErr = e
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// pipeline runs the commands in one round trip and returns their replies.
+// An idle connection the server has closed meanwhile is replaced once; one
+// that timed out is not, the commands may have run.
+func (c *redisClient) pipeline(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	for fresh := false; ; fresh = true {
+		conn, pooled, err := c.conn(ctx, fresh)
+		if err != nil {
+			redisErrors.inc(strings.ToLower(cmds[0][0]))
+			return nil, fmt.Errorf("redis: %v", err)
+		}
+		replies, err := c.roundTrip(ctx, conn, cmds)
+		if _, ok := err.(redisError); ok || err == nil {
+			c.release(conn)
+		} else {
+			conn.Close()
+			if ne, ok := err.(net.Error); pooled && !(ok && ne.Timeout()) {
+				continue
+			}
+			err = fmt.Errorf("redis: %v", err)
+		}
+		if err != nil {
+			redisErrors.inc(strings.ToLower(cmds[0][0]))
+		}
+		return replies, err
+	}
+}
+
+func (c *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// tx runs the commands atomically in a MULTI/EXEC transaction and returns
+// their replies.
+func (c *redisClient) tx(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	all := make([][]string, 0, len(cmds)+2)
+	all = append(all, []string{"MULTI"})
+	all = append(all, cmds...)
+	all = append(all, []string{"EXEC"})
+	replies, err := c.pipeline(ctx, all...)
+	if err != nil {
+		return nil, err
+	}
+	out, ok := replies[len(replies)-1].([]interface{})
+	if !ok || len(out) != len(cmds) {
+		return nil, errors.New("redis: transaction was aborted")
+	}
+	for _, reply := range out {
+		if err, ok := reply.(redisError); ok {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// readReply reads a RESP reply: a string for a status, redisError for an
+// error, int64, []byte or nil for a bulk string and []interface{} for an
+// array.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			// Replies inside EXEC may be errors of single commands.
+			out[i], err = readReply(r)
+			if e, ok := err.(redisError); ok {
+				out[i], err = e, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// replyInt reads an integer out of a reply, integer or bulk; nil is 0.
+func replyInt(reply interface{}) int {
+	switch v := reply.(type) {
+	case int64:
+		return int(v)
+	case []byte:
+		n, _ := strconv.Atoi(string(v))
+		return n
+	}
+	return 0
+}
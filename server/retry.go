@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	errDeadlock        = 1213
+	errLockWaitTimeout = 1205
+
+	maxRetryBackoff = 2 * time.Second
+)
+
+var (
+	dbRetries   = newCounter("mysql_retries_total", "Storage operations retried after a transient error, by operation.", "op")
+	dbExhausted = newCounter("mysql_retries_exhausted_total", "Storage operations that still failed after the last attempt, by operation.", "op")
+	dbDuration  = newHistogram("mysql_query_duration_seconds", "Time taken by each attempt of a storage operation, by operation.", []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}, "op")
+)
+
+// withRetry runs a storage operation up to -db_retry_attempts times while it
+// fails with a transient error, sleeping a jittered exponential backoff
+// between attempts. The operation must be safe to repeat, which holds for a
+// whole transaction that was rolled back. Transactions end with commit, so a
+// failed commit, which may have committed all the same, is never repeated.
+// While the circuit breaker is open the operation is not run at all and
+// errStoreDown is returned.
+func withRetry(ctx context.Context, op string, fn func() error) error {
+	if !breaker.allow() {
+		return errStoreDown
+	}
+	err := retry(ctx, op, fn)
+	breaker.record(err)
+	return err
+}
+
+func retry(ctx context.Context, op string, fn func() error) error {
+	backoff := db_retry_backoff
+	for attempt := 1; ; attempt++ {
+		err := timed(ctx, op, fn)
+		if err == nil || !transient(err) {
+			return err
+		}
+		if attempt >= db_retry_attempts {
+			dbExhausted.inc(op)
+			return err
+		}
+		dbRetries.inc(op)
+		// Full jitter keeps clients that collided in a deadlock from
+		// colliding again on the next attempt.
+		sleep := time.Duration(rand.Int63n(int64(backoff) + 1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// timed runs one attempt of a storage operation, observing how long it took
+// and logging it with the request ID when it took -slow_query_threshold or
+// longer.
+func timed(ctx context.Context, op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	took := time.Since(start)
+	dbDuration.observe(took.Seconds(), op)
+	if slow_query_threshold > 0 && took >= slow_query_threshold {
+		log.Printf("Slow query %s took %s, request %s\n", op, took, requestIDOf(ctx))
+	}
+	return err
+}
+
+// commitError is the error of a commit. The connection may have broken
+// after the server committed, so the transaction is not known to have
+// failed.
+type commitError struct {
+	err error
+}
+
+func (e commitError) Error() string { return e.err.Error() }
+
+func (e commitError) Unwrap() error { return e.err }
+
+// commit commits tx, marking its error as a commitError.
+func commit(tx *sql.Tx) error {
+	if err := tx.Commit(); err != nil {
+		return commitError{err}
+	}
+	return nil
+}
+
+// transient reports whether an error is worth retrying: deadlocks and lock
+// wait timeouts, which roll the transaction back, and connections that
+// failed before the statement was sent. Connections breaking while a
+// statement or commit ran may have left its writes behind, their errors go
+// to the caller.
+func transient(err error) bool {
+	if errors.As(err, &commitError{}) {
+		return false
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == errDeadlock || mysqlErr.Number == errLockWaitTimeout
+	}
+	var opErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// brokenConnection reports whether an error came from the connection to the
+// database rather than from the statement, which the circuit breaker counts
+// whether or not it was retried.
+func brokenConnection(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &opErr)
+}
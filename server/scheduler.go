@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -schedule runs maintenance jobs at the times of cron expressions. Every
+// run is a job at /admin/jobs and is cancelled, and waited for, when the
+// server shuts down. A job never overlaps itself: the runs it misses while
+// the previous one is still going are skipped, and with Redis only one
+// replica runs each of them.
+
+// scheduledJobs are the jobs -schedule can name. A job whose feature is not
+// configured is refused by configure.
+var scheduledJobs = map[string]struct {
+	configured func() bool
+	run        func(ctx context.Context) (int, error)
+}{
+	"archive": {func() bool { return archive_after > 0 }, archiveOlderMessages},
+	"backup": {func() bool { return true }, func(ctx context.Context) (int, error) {
+		_, rows, err := backupDatabase(ctx)
+		return rows, err
+	}},
+	"sweep_caches": {func() bool { return true }, func(ctx context.Context) (int, error) {
+		return cachedStats.sweep() + nonces.sweep(), nil
+	}},
+	"trim_usage": {func() bool { return usage_retention > 0 }, trimUsage},
+}
+
+type scheduledJob struct {
+	name     string
+	spec     string
+	schedule *cronSchedule
+}
+
+var schedules []scheduledJob
+
+var (
+	scheduledRuns     = newCounter("scheduled_job_runs_total", "Runs of scheduled jobs, by job and status.", "job", "status")
+	scheduledSkipped  = newCounter("scheduled_job_skipped_total", "Runs of scheduled jobs skipped, by job and reason: overlap or claimed by another replica.", "job", "reason")
+	scheduledDuration = newHistogram("scheduled_job_duration_seconds", "Time taken by runs of scheduled jobs, by job.", []float64{.01, .1, 1, 10, 60, 300, 900, 3600}, "job")
+)
+
+// lastSuccess is when each scheduled job last finished without an error.
+var lastSuccess = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: map[string]time.Time{}}
+
+func init() {
+	newGaugeFunc("scheduled_job_last_success_timestamp_seconds", "When the scheduled job last succeeded, in Unix seconds, by job.", []string{"job"}, func() []sample {
+		lastSuccess.Lock()
+		defer lastSuccess.Unlock()
+		out := make([]sample, 0, len(lastSuccess.at))
+		for name, at := range lastSuccess.at {
+			out = append(out, sample{labels: []string{name}, value: float64(at.UnixNano()) / 1e9})
+		}
+		return out
+	})
+}
+
+// parseSchedule parses -schedule, semicolon separated job=cron entries.
+func parseSchedule(spec string) ([]scheduledJob, error) {
+	var out []scheduledJob
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.IndexByte(entry, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("Schedule %q must be job=cron", entry)
+		}
+		sj := scheduledJob{name: strings.TrimSpace(entry[:i]), spec: strings.TrimSpace(entry[i+1:])}
+		known, ok := scheduledJobs[sj.name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown scheduled job %q", sj.name)
+		}
+		if !known.configured() {
+			return nil, fmt.Errorf("Scheduled job %q needs its feature configured", sj.name)
+		}
+		if seen[sj.name] {
+			return nil, fmt.Errorf("Job %q is scheduled twice", sj.name)
+		}
+		seen[sj.name] = true
+		var err error
+		if sj.schedule, err = parseCron(sj.spec); err != nil {
+			return nil, err
+		}
+		out = append(out, sj)
+	}
+	return out, nil
+}
+
+func isScheduled(name string) bool {
+	for _, sj := range schedules {
+		if sj.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduler runs sj at its times until ctx is cancelled.
+func scheduler(ctx context.Context, logger *log.Logger, sj scheduledJob) {
+	at := sj.schedule.next(time.Now())
+	for !at.IsZero() {
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if claimRun(ctx, logger, sj, at) {
+			runScheduled(ctx, logger, sj)
+		} else {
+			scheduledSkipped.inc(sj.name, "claimed")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// The times that passed during the run are skipped rather than
+		// run back to back.
+		now := time.Now()
+		for at = sj.schedule.next(at); !at.IsZero() && !at.After(now); at = sj.schedule.next(at) {
+			scheduledSkipped.inc(sj.name, "overlap")
+		}
+	}
+	logger.Printf("Scheduled job %s never runs again with %q\n", sj.name, sj.spec)
+}
+
+func runScheduled(ctx context.Context, logger *log.Logger, sj scheduledJob) {
+	j, jctx := newJob(ctx, sj.name, map[string]string{"schedule": sj.spec})
+	start := time.Now()
+	status := j.run(jctx, logger, func(ctx context.Context, j *job) error {
+		n, err := scheduledJobs[sj.name].run(ctx)
+		j.progress(n)
+		return err
+	})
+	scheduledDuration.observe(time.Since(start).Seconds(), sj.name)
+	scheduledRuns.inc(sj.name, status)
+	if status == jobDone {
+		lastSuccess.Lock()
+		lastSuccess.at[sj.name] = time.Now()
+		lastSuccess.Unlock()
+	}
+}
+
+// claimRun reports whether this replica runs sj at at. With Redis the first
+// replica to claim the time does, until the next time; without it, or while
+// it fails, every replica does.
+func claimRun(ctx context.Context, logger *log.Logger, sj scheduledJob, at time.Time) bool {
+	if rdb == nil {
+		return true
+	}
+	lease := time.Minute
+	if next := sj.schedule.next(at); !next.IsZero() {
+		lease = next.Sub(at)
+	}
+	reply, err := rdb.do(ctx, "SET", rdb.key("schedule", sj.name, strconv.FormatInt(at.Unix(), 10)), "1", "NX", "PX", strconv.FormatInt(int64(lease/time.Millisecond), 10))
+	if err != nil {
+		logger.Println("Could not claim scheduled job", sj.name+":", err)
+		return true
+	}
+	return reply != nil
+}
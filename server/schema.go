@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// schemaTypes are the request and response bodies described at /schema, by
+// the name of their definition.
+var schemaTypes = map[string]interface{}{
+	"message": messageType{},
+	// new_message is the body of /add and PUT /messages/{id}.
+	"new_message":     messageInput{},
+	"attachment":      attachmentType{},
+	"reaction":        reactionType{},
+	"batch_request":   batchRequest{},
+	"batch_response":  batchResponse{},
+	"reaction_counts": reactionCounts{},
+	"tag_count":       tagCount{},
+	"message_stats":   messageStats{},
+	"flagged_message": flaggedMessage{},
+}
+
+// jsonSchema builds a JSON Schema document with a definition for each of
+// schemaTypes from their struct fields and json tags. Fields without
+// omitempty are required.
+func jsonSchema() map[string]interface{} {
+	names := map[reflect.Type]string{}
+	for name, v := range schemaTypes {
+		names[reflect.TypeOf(v)] = name
+	}
+	defs := map[string]interface{}{}
+	for name, v := range schemaTypes {
+		defs[name] = structSchema(reflect.TypeOf(v), names)
+	}
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$defs":   defs,
+	}
+}
+
+func structSchema(t reflect.Type, names map[reflect.Type]string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	addFields(t, names, properties, &required)
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds the fields of t to properties. Fields of embedded structs
+// come last so the fields of t shadow them, as they do in encoding/json.
+func addFields(t reflect.Type, names map[reflect.Type]string, properties map[string]interface{}, required *[]string) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, f.Type)
+			continue
+		}
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+		if _, ok := properties[name]; ok {
+			continue
+		}
+		properties[name] = typeSchema(f.Type, names)
+		omitempty := false
+		for _, opt := range parts[1:] {
+			omitempty = omitempty || opt == "omitempty"
+		}
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+	for _, e := range embedded {
+		addFields(e, names, properties, required)
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func typeSchema(t reflect.Type, names map[reflect.Type]string) map[string]interface{} {
+	if name, ok := names[t]; ok {
+		return map[string]interface{}{"$ref": "#/$defs/" + name}
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), names)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), names)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), names)}
+	case reflect.Struct:
+		return structSchema(t, names)
+	}
+	return map[string]interface{}{}
+}
+
+// schema serves /schema, the JSON Schema of the API bodies. ?type= returns
+// a single definition.
+func schema() http.Handler {
+	doc := jsonSchema()
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, "Only GET method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		out := doc
+		if name := r.URL.Query().Get("type"); name != "" {
+			if _, ok := doc["$defs"].(map[string]interface{})[name]; !ok {
+				http.Error(rw, "Unknown type!", http.StatusNotFound)
+				return
+			}
+			out = map[string]interface{}{
+				"$schema": doc["$schema"],
+				"$ref":    "#/$defs/" + name,
+				"$defs":   doc["$defs"],
+			}
+		}
+		rw.Header().Set("Content-Type", "application/schema+json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
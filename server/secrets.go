@@ -0,0 +1,154 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// A secret is a flag that can also be read from a file, the way Docker and
+// Kubernetes mount secrets. The file is named by -<flag>_file or by the
+// <FLAG>_FILE environment variable and wins over the flag itself.
+// The flag variables are only set at startup, reloads put their values in
+// current, where everything reading a secret that can change finds it.
+type secret struct {
+	flag    string
+	value   *string
+	file    string
+	current atomic.Value
+}
+
+var secrets = []*secret{
+	{flag: "access_key", value: &access_key},
+	{flag: "admin_key", value: &admin_key},
+	{flag: "mysql_dsn", value: &mysql_dsn},
+	{flag: "mysql_read_dsn", value: &mysql_read_dsn},
+	{flag: "encryption_keys", value: &encryption_keys},
+	{flag: "redis_password", value: &redis_password},
+	{flag: "events_url", value: &events_url},
+}
+
+func registerSecretFlags(fs *flag.FlagSet) {
+	for _, s := range secrets {
+		fs.StringVar(&s.file, s.flag+"_file", "", fmt.Sprintf("File to read -%s from, defaults to $%s", s.flag, s.env()))
+	}
+}
+
+func (s *secret) env() string {
+	return strings.ToUpper(s.flag) + "_FILE"
+}
+
+// read reads the secret from its file, returning the flag when it has no
+// file.
+func (s *secret) read() (string, error) {
+	path := s.file
+	if path == "" {
+		path = os.Getenv(s.env())
+	}
+	if path == "" {
+		return *s.value, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read -%s: %v", s.flag, err)
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "" {
+		return "", fmt.Errorf("Could not read -%s: %s is empty", s.flag, path)
+	}
+	return value, nil
+}
+
+func (s *secret) get() string {
+	value, _ := s.current.Load().(string)
+	return value
+}
+
+// loadSecrets reads the secret files into their flags, before anything
+// reading them starts.
+func loadSecrets() error {
+	for _, s := range secrets {
+		value, err := s.read()
+		if err != nil {
+			return err
+		}
+		*s.value = value
+		s.current.Store(value)
+	}
+	return nil
+}
+
+// currentSecret is the value of the secret of flag in use.
+func currentSecret(flag string) string {
+	for _, s := range secrets {
+		if s.flag == flag {
+			return s.get()
+		}
+	}
+	return ""
+}
+
+func adminKey() string {
+	return currentSecret("admin_key")
+}
+
+// reloadSecrets reads the secret files again and puts changed values to use:
+// the access key of the default channel, the admin key, the Redis password
+// and the events URL take effect with the next request or connection,
+// changed DSNs get new connection pools. Only the values in current change,
+// all of them or, when one cannot be read or used, none.
+func reloadSecrets(logger *log.Logger) {
+	values := map[string]string{}
+	for _, s := range secrets {
+		value, err := s.read()
+		if err != nil {
+			logger.Println("Could not reload secrets:", err)
+			return
+		}
+		values[s.flag] = value
+	}
+	kr, err := parseKeyring(values["encryption_keys"], encryption_key_id)
+	if err != nil {
+		logger.Println("Could not reload encryption keys:", err)
+		return
+	}
+	dsn, readDSN := "", ""
+	if values["mysql_dsn"] != currentSecret("mysql_dsn") {
+		dsn = values["mysql_dsn"]
+	}
+	// A replica is only checked when the server started with one, so a read
+	// DSN that appears later is left for the next restart.
+	if values["mysql_read_dsn"] != currentSecret("mysql_read_dsn") && mysql_read_dsn != "" {
+		readDSN = values["mysql_read_dsn"]
+	}
+	if err := reopenDB(dsn, readDSN); err != nil {
+		logger.Println("Could not reopen db:", err)
+		return
+	}
+	for _, s := range secrets {
+		s.current.Store(values[s.flag])
+	}
+	channels[defaultChannel].key.Store(values["access_key"])
+	currentKeyring.Store(kr)
+	logger.Println("Secrets reloaded")
+}
+
+// reloadOnHangup reloads the secrets on every SIGHUP until done is closed.
+func reloadOnHangup(logger *log.Logger, done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+			reloadSecrets(logger)
+		}
+	}
+}
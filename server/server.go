@@ -0,0 +1,285 @@
+// Package server is the message board API. The binary at the root of the
+// module runs it standalone, New sets it up to be mounted in another
+// program's mux.
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of lifecycle events a Server sends.
+const (
+	EventStarting     = "starting"
+	EventListening    = "listening"
+	EventReady        = "ready"
+	EventShuttingDown = "shutting_down"
+	EventStopped      = "stopped"
+	EventFailed       = "failed"
+)
+
+// An Event is a step in the life of a Server. Err is set on EventFailed.
+type Event struct {
+	Kind string
+	At   time.Time
+	Err  error
+}
+
+// Server runs the HTTP server with the background workers around it. Hooks
+// and workers are registered before Start; OnReady hooks run once the
+// server is listening and, with -wait_for_db, the database is available,
+// OnShutdown hooks once shutdown begins, before connections are drained.
+type Server struct {
+	logger *log.Logger
+	routes http.Handler
+	http   *http.Server
+	events chan Event
+
+	mu         sync.Mutex
+	onStart    []func()
+	onReady    []func()
+	onShutdown []func(ctx context.Context)
+	workers    []func(ctx context.Context)
+	listener   net.Listener
+
+	background     context.Context
+	stopBackground context.CancelFunc
+	startOnce      sync.Once
+	running        sync.WaitGroup
+	served         chan struct{}
+}
+
+// newServer sets up the routes and the built in workers. configure must
+// have been called.
+func newServer(logger *log.Logger) *Server {
+	s := &Server{
+		logger: logger,
+		events: make(chan Event, 32),
+		served: make(chan struct{}),
+	}
+	s.background, s.stopBackground = context.WithCancel(context.Background())
+	s.routes = routes(s.background, logger)
+	s.http = &http.Server{
+		Addr:              ":" + port,
+		Handler:           s.Handler(Tracing(), Featuring(), Logging(logger), Capturing(logger), Localizing(), Deadlines(), Chaos(), Limiting()),
+		ErrorLog:          logger,
+		MaxHeaderBytes:    max_header_bytes,
+		ReadHeaderTimeout: read_header_timeout,
+		ReadTimeout:       5 * time.Second,
+		IdleTimeout:       15 * time.Second,
+	}
+
+	s.Go(func(ctx context.Context) { reloadOnHangup(logger, ctx.Done()) })
+	if mysql_read_dsn != "" {
+		s.Go(func(ctx context.Context) { replicaChecker(ctx, logger) })
+	}
+	if archive_after > 0 && !isScheduled("archive") {
+		s.Go(func(ctx context.Context) { archiver(ctx, logger) })
+	}
+	for _, sj := range schedules {
+		sj := sj
+		s.Go(func(ctx context.Context) { scheduler(ctx, logger, sj) })
+	}
+	if rdb != nil {
+		s.Go(func(ctx context.Context) { usageFlusher(ctx, logger) })
+	}
+	if events_url != "" {
+		s.Go(func(ctx context.Context) { eventPublisher(ctx, logger) })
+	}
+	// Long polls would hold up draining the connections for up to
+	// -long_poll_max.
+	s.OnShutdown(func(context.Context) { hub.close() })
+	return s
+}
+
+// routes is the router of every endpoint, described by apiRoutes. Work
+// handlers start in the background is cancelled with ctx.
+func routes(ctx context.Context, logger *log.Logger) http.Handler {
+	channelRouter := http.NewServeMux()
+	registerMessageRoutes(channelRouter)
+
+	router := http.NewServeMux()
+	handle(router, "/", index())
+	registerMessageRoutes(router)
+	router.Handle("/channels/", channelRoutes(channelRouter))
+	handle(router, "/health", healthz())
+	handle(router, "/readyz", readyz())
+	handle(router, "/metrics", metricsHandler())
+	handle(router, "/schema", schema())
+	handle(router, "/openapi.json", openAPIDocument())
+	handle(router, "/admin/flagged", flaggedMessages())
+	handle(router, "/admin/flagged/", adminFlaggedRoutes())
+	handle(router, "/admin/capture", captureToggle())
+	handle(router, "/admin/usage", listUsage())
+	handle(router, "/admin/stats", adminStats())
+	handle(router, "/admin/reencrypt", reencrypt(ctx, logger))
+	handle(router, chaosRoute, chaosAdmin())
+	handle(router, "/admin/features", featuresAdmin())
+	handle(router, "/admin/messages", purgeMessages(ctx, logger))
+	handle(router, "/admin/jobs", jobRoutes())
+	handle(router, "/admin/jobs/", jobRoutes())
+	return describing(router)
+}
+
+// OnStart registers fn to run when the server starts, before it serves the
+// first request.
+func (s *Server) OnStart(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onStart = append(s.onStart, fn)
+}
+
+// OnReady registers fn to run when the server is ready for traffic.
+func (s *Server) OnReady(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReady = append(s.onReady, fn)
+}
+
+// OnShutdown registers fn to run when shutdown begins. ctx ends when the
+// shutdown deadline passes.
+func (s *Server) OnShutdown(fn func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, fn)
+}
+
+// Go registers a worker started with the server. Its context is cancelled
+// when shutdown begins and shutdown waits for it to return.
+func (s *Server) Go(fn func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers = append(s.workers, fn)
+}
+
+// Events returns the lifecycle events of the server. Events are dropped
+// when nobody keeps up with reading them.
+func (s *Server) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Server) emit(kind string, err error) {
+	select {
+	case s.events <- Event{Kind: kind, At: time.Now(), Err: err}:
+	default:
+	}
+}
+
+// Addr is the address the server listens on, once it started.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Start listens on -port, starts the workers and serves in the background,
+// returning once the listener is open.
+func (s *Server) Start() error {
+	s.emit(EventStarting, nil)
+	ln, err := listen(s.http.Addr)
+	if err != nil {
+		s.emit(EventFailed, err)
+		return err
+	}
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+	s.StartWorkers()
+	go func() {
+		defer close(s.served)
+		if err := s.http.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.Printf("Could not serve on %s: %v\n", port, err)
+			s.emit(EventFailed, err)
+		}
+	}()
+	s.emit(EventListening, nil)
+	return nil
+}
+
+// StartWorkers starts the workers, runs the OnStart hooks and marks the
+// server healthy, and ready once -wait_for_db is satisfied. Start calls it,
+// programs serving Handler themselves call it instead.
+func (s *Server) StartWorkers() {
+	s.startOnce.Do(func() {
+		s.mu.Lock()
+		workers, onStart := s.workers, s.onStart
+		s.mu.Unlock()
+		for _, fn := range workers {
+			fn := fn
+			s.running.Add(1)
+			go func() {
+				defer s.running.Done()
+				fn(s.background)
+			}()
+		}
+		for _, fn := range onStart {
+			fn()
+		}
+		atomic.StoreInt32(&healthy, 1)
+
+		if !wait_for_db {
+			s.setReady()
+			return
+		}
+		go func() {
+			if err := waitForDB(s.background, s.logger, wait_for_db_timeout); err != nil {
+				if s.background.Err() == nil {
+					s.logger.Fatalln("Database did not become available:", err)
+				}
+				return
+			}
+			s.setReady()
+		}()
+	})
+}
+
+func (s *Server) setReady() {
+	atomic.StoreInt32(&ready, 1)
+	s.mu.Lock()
+	onReady := s.onReady
+	s.mu.Unlock()
+	for _, fn := range onReady {
+		fn()
+	}
+	s.emit(EventReady, nil)
+}
+
+// Stopped is closed when serving on the listener of Start ended, after
+// Shutdown or because it failed.
+func (s *Server) Stopped() <-chan struct{} {
+	return s.served
+}
+
+// Shutdown fails the health checks, runs the OnShutdown hooks, stops the
+// workers and the jobs started by requests and drains the connections until
+// ctx ends.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.emit(EventShuttingDown, nil)
+	atomic.StoreInt32(&healthy, 0)
+	s.mu.Lock()
+	onShutdown := s.onShutdown
+	s.mu.Unlock()
+	for _, fn := range onShutdown {
+		fn(ctx)
+	}
+	s.stopBackground()
+
+	s.http.SetKeepAlivesEnabled(false)
+	err := s.http.Shutdown(ctx)
+	s.running.Wait()
+	waitBackground()
+	if err != nil {
+		s.emit(EventFailed, err)
+		return err
+	}
+	s.emit(EventStopped, nil)
+	return nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Machine clients can sign requests instead of sending the access key. The
+// signature is the hex encoded HMAC-SHA256, keyed with the access key of the
+// channel, of
+//
+//	METHOD \n PATH?QUERY \n X-Timestamp \n X-Nonce \n hex(SHA-256(body))
+//
+// sent as X-Signature. X-Timestamp is in Unix seconds and must be within
+// -hmac_max_skew of the server clock, X-Nonce is a random string that may
+// only be used once, on any replica when they share -redis_addr.
+
+var signedRequests = newCounter("http_signed_requests_total", "Requests authenticated by signature, by result.", "result")
+
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+var nonces = nonceCache{seen: map[string]time.Time{}}
+
+// use records a nonce until it expires and reports whether it was unused.
+// Nonces older than the allowed skew are rejected by their timestamp, so
+// they do not need to be remembered longer than that.
+func (c *nonceCache) use(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > hmac_max_skew {
+		c.prune(now)
+	}
+	if exp, ok := c.seen[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+func (c *nonceCache) prune(now time.Time) int {
+	n := 0
+	for nonce, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, nonce)
+			n++
+		}
+	}
+	c.pruned = now
+	return n
+}
+
+// sweep forgets the expired nonces and returns how many.
+func (c *nonceCache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.prune(time.Now())
+}
+
+// spendNonce records that nonce was used in scope until expires and reports
+// whether it was unused. With Redis the nonces are shared, so a request is
+// not replayed against another replica; while Redis fails, and without it,
+// each replica remembers its own.
+func spendNonce(ctx context.Context, scope, nonce string, expires time.Time) bool {
+	if rdb != nil {
+		ttl := time.Until(expires)
+		if ttl < time.Millisecond {
+			ttl = time.Millisecond
+		}
+		reply, err := rdb.do(ctx, "SET", rdb.key("nonce", scope, nonce), "1", "NX", "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+		if err == nil {
+			return reply != nil
+		}
+		log.Println("Could not spend nonce in Redis:", err)
+	}
+	return nonces.use(scope+"\n"+nonce, expires)
+}
+
+// verifySignature checks the signature of a request against key, made at
+// most skew from now. Nonces are spent per scope. The body is read to be
+// hashed and replaced so handlers can read it again.
+func verifySignature(r *http.Request, key, scope string, skew time.Duration) error {
+	ts, err := strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+	if err != nil {
+		return errors.New("X-Timestamp is required with X-Signature!")
+	}
+	signedAt := time.Unix(ts, 0)
+	if off := time.Since(signedAt); off > skew || off < -skew {
+		return errors.New("Signature has expired!")
+	}
+	nonce := r.Header.Get("X-Nonce")
+	if nonce == "" || len(nonce) > 128 {
+		return errors.New("X-Nonce is required with X-Signature!")
+	}
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil {
+		return errors.New("Signature is not valid")
+	}
+
+	body := sha256.New()
+	if r.Body != nil {
+		limit := int64(attachment_max_count)*attachment_max_bytes + 1<<20
+		b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			return errors.New("Unable to read body!")
+		}
+		if int64(len(b)) > limit {
+			return errors.New("Body is too large to be signed!")
+		}
+		body.Write(b)
+		r.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	target := channelOf(r).prefix() + r.URL.Path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	io.WriteString(mac, r.Method+"\n"+target+"\n"+r.Header.Get("X-Timestamp")+"\n"+nonce+"\n"+hex.EncodeToString(body.Sum(nil)))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("Signature is not valid")
+	}
+	// The nonce is only spent by a valid signature, so forged requests
+	// cannot burn the nonces of real ones.
+	if !spendNonce(r.Context(), scope, nonce, signedAt.Add(skew)) {
+		return errors.New("Nonce was already used!")
+	}
+	return nil
+}
+
+// signedAuthorized authenticates a request by its signature, writing the
+// error response when it is not valid.
+func signedAuthorized(rw http.ResponseWriter, r *http.Request) bool {
+	if err := verifySignature(r, channelOf(r).accessKey(), channelOf(r).name, hmac_max_skew); err != nil {
+		signedRequests.inc("rejected")
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	signedRequests.inc("accepted")
+	return true
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sign(key, method, target, ts, nonce, body string) string {
+	sum := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(key))
+	io.WriteString(mac, method+"\n"+target+"\n"+ts+"\n"+nonce+"\n"+hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	defer func(count int, bytes int64) { attachment_max_count, attachment_max_bytes = count, bytes }(attachment_max_count, attachment_max_bytes)
+	attachment_max_count, attachment_max_bytes = 0, 0
+	const key, skew = "secret", 5 * time.Minute
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-skew-time.Minute).Unix(), 10)
+	ahead := strconv.FormatInt(time.Now().Add(skew+time.Minute).Unix(), 10)
+	tests := []struct {
+		name          string
+		method, path  string
+		channel, body string
+		ts, nonce     string
+		// signedTarget and signedBody, when set, are signed instead of the
+		// ones of the request.
+		signedTarget, signedBody string
+		signature                string
+		want                     string
+	}{
+		{name: "valid", method: "GET", path: "/messages?limit=5", ts: now, nonce: "a1"},
+		{name: "valid with body", method: "POST", path: "/messages", body: `{"text":"hi"}`, ts: now, nonce: "a2"},
+		{name: "valid on a channel", method: "DELETE", path: "/messages/1", channel: "ops", ts: now, nonce: "a3"},
+		{name: "channel prefix is signed", method: "DELETE", path: "/messages/1", channel: "ops", signedTarget: "/messages/1", ts: now, nonce: "a4", want: "Signature is not valid"},
+		{name: "query is signed", method: "GET", path: "/messages?limit=500", signedTarget: "/messages?limit=5", ts: now, nonce: "a5", want: "Signature is not valid"},
+		{name: "body is signed", method: "POST", path: "/messages", body: `{"text":"bye"}`, signedBody: `{"text":"hi"}`, ts: now, nonce: "a6", want: "Signature is not valid"},
+		{name: "wrong key", method: "GET", path: "/messages", ts: now, nonce: "a7", signature: sign("other", "GET", "/messages", now, "a7", ""), want: "Signature is not valid"},
+		{name: "not hex", method: "GET", path: "/messages", ts: now, nonce: "a8", signature: "zz", want: "Signature is not valid"},
+		{name: "no timestamp", method: "GET", path: "/messages", nonce: "a9", want: "X-Timestamp is required with X-Signature!"},
+		{name: "timestamp not a number", method: "GET", path: "/messages", ts: "soon", nonce: "a10", want: "X-Timestamp is required with X-Signature!"},
+		{name: "expired", method: "GET", path: "/messages", ts: old, nonce: "a11", want: "Signature has expired!"},
+		{name: "from the future", method: "GET", path: "/messages", ts: ahead, nonce: "a12", want: "Signature has expired!"},
+		{name: "no nonce", method: "GET", path: "/messages", ts: now, want: "X-Nonce is required with X-Signature!"},
+		{name: "nonce too long", method: "GET", path: "/messages", ts: now, nonce: strings.Repeat("n", 129), want: "X-Nonce is required with X-Signature!"},
+		{name: "body too large", method: "POST", path: "/messages", body: strings.Repeat("x", 1<<20+1), ts: now, nonce: "a13", want: "Body is too large to be signed!"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		c := newChannel(defaultChannel, key)
+		target := tt.path
+		if tt.channel != "" {
+			c = newChannel(tt.channel, key)
+			target = "/channels/" + tt.channel + tt.path
+		}
+		r = r.WithContext(context.WithValue(r.Context(), channelKey, c))
+		if tt.signedTarget != "" {
+			target = tt.signedTarget
+		}
+		body := tt.body
+		if tt.signedBody != "" {
+			body = tt.signedBody
+		}
+		signature := tt.signature
+		if signature == "" {
+			signature = sign(key, tt.method, target, tt.ts, tt.nonce, body)
+		}
+		r.Header.Set("X-Timestamp", tt.ts)
+		r.Header.Set("X-Nonce", tt.nonce)
+		r.Header.Set("X-Signature", signature)
+
+		err := verifySignature(r, key, "test", skew)
+		if got := errString(err); got != tt.want {
+			t.Errorf("%s: error = %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		if err == nil {
+			if b, _ := io.ReadAll(r.Body); string(b) != tt.body {
+				t.Errorf("%s: body after verifying = %q, want %q", tt.name, b, tt.body)
+			}
+		}
+	}
+}
+
+func TestVerifySignatureNonce(t *testing.T) {
+	const key, skew = "secret", 5 * time.Minute
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	request := func(nonce, signature string) *http.Request {
+		r := httptest.NewRequest("GET", "/messages", nil)
+		r = r.WithContext(context.WithValue(r.Context(), channelKey, newChannel(defaultChannel, key)))
+		r.Header.Set("X-Timestamp", now)
+		r.Header.Set("X-Nonce", nonce)
+		r.Header.Set("X-Signature", signature)
+		return r
+	}
+	valid := sign(key, "GET", "/messages", now, "n1", "")
+
+	// A forged signature does not spend the nonce.
+	if err := verifySignature(request("n1", sign("other", "GET", "/messages", now, "n1", "")), key, "nonce", skew); errString(err) != "Signature is not valid" {
+		t.Fatalf("forged: error = %v", err)
+	}
+	if err := verifySignature(request("n1", valid), key, "nonce", skew); err != nil {
+		t.Fatalf("first use: error = %v", err)
+	}
+	if err := verifySignature(request("n1", valid), key, "nonce", skew); errString(err) != "Nonce was already used!" {
+		t.Fatalf("replay: error = %v", err)
+	}
+	// Nonces are spent per scope.
+	if err := verifySignature(request("n1", valid), key, "nonce-other", skew); err != nil {
+		t.Fatalf("other scope: error = %v", err)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statsBuckets are the bucket sizes of /messages/stats with the format
+// grouping timestamps into them and the range covered when none is given.
+var statsBuckets = map[string]struct {
+	format string
+	span   string
+}{
+	"day":  {"%Y-%m-%d", "7 DAY"},
+	"hour": {"%Y-%m-%d %H:00", "24 HOUR"},
+}
+
+type statsBucket struct {
+	Start string `json:"start"`
+	Count int    `json:"count"`
+}
+
+type messageStats struct {
+	Total         int           `json:"total"`
+	AverageLength float64       `json:"average_length"`
+	Latest        *time.Time    `json:"latest,omitempty"`
+	Bucket        string        `json:"bucket"`
+	Buckets       []statsBucket `json:"buckets"`
+	// Encrypted messages are in Total but not in AverageLength, their
+	// length is not known without decrypting them.
+	Encrypted int `json:"encrypted,omitempty"`
+}
+
+// statsCache keeps /messages/stats responses for -stats_cache_ttl, the
+// aggregates scan the whole channel. With Redis they are kept there for all
+// replicas, and here only while it fails.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[string]statsEntry
+}
+
+type statsEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+var cachedStats = statsCache{entries: map[string]statsEntry{}}
+
+func (c *statsCache) get(ctx context.Context, key string) ([]byte, bool) {
+	if rdb != nil {
+		reply, err := rdb.do(ctx, "GET", rdb.key("stats", key))
+		if err == nil {
+			body, ok := reply.([]byte)
+			return body, ok
+		}
+		log.Println(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.body, true
+}
+
+func (c *statsCache) put(ctx context.Context, key string, body []byte) {
+	if rdb != nil {
+		ttl := strconv.FormatInt(int64(stats_cache_ttl/time.Millisecond), 10)
+		_, err := rdb.do(ctx, "SET", rdb.key("stats", key), string(body), "PX", ttl)
+		if err == nil {
+			return
+		}
+		log.Println(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Ranges are chosen by clients, so the cache is emptied rather than
+	// growing without bound.
+	if len(c.entries) >= 100 {
+		c.entries = map[string]statsEntry{}
+	}
+	c.entries[key] = statsEntry{body: body, expires: time.Now().Add(stats_cache_ttl)}
+}
+
+// sweep drops the expired entries and returns how many. Redis expires its
+// own.
+func (c *statsCache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now, n := time.Now(), 0
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// listStats serves /messages/stats: the number of messages in the channel,
+// the average length of those not encrypted and the time of the newest, and
+// the number of messages per ?bucket=day or hour from ?from= until before
+// ?to=. Without a range the last 7 days or 24 hours are counted.
+func listStats() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		bucket := q.Get("bucket")
+		if bucket == "" {
+			bucket = "day"
+		}
+		b, ok := statsBuckets[bucket]
+		if !ok {
+			http.Error(rw, "bucket must be day or hour!", http.StatusBadRequest)
+			return
+		}
+		from, to := q.Get("from"), q.Get("to")
+		var fromTime, toTime time.Time
+		var err error
+		if from != "" {
+			fromTime, err = parseTime(from)
+		}
+		if err == nil && to != "" {
+			toTime, err = parseTime(to)
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cacheKey := channelOf(r).name + "\n" + bucket + "\n" + from + "\n" + to
+		if stats_cache_ttl > 0 {
+			if body, ok := cachedStats.get(r.Context(), cacheKey); ok {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.Write(body)
+				return
+			}
+		}
+
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		where := " FROM messages WHERE channel = ? AND flagged = 0"
+		args := []interface{}{channelOf(r).name}
+		out := messageStats{Bucket: bucket, Buckets: []statsBucket{}}
+		var latest sql.NullTime
+		err = withRetry(r.Context(), "message_stats", func() error {
+			return db.QueryRow("SELECT COUNT(*), COALESCE(AVG(CASE WHEN key_id IS NULL THEN CHAR_LENGTH(message) END), 0), COUNT(key_id), MAX(timestamp)"+where, args...).Scan(&out.Total, &out.AverageLength, &out.Encrypted, &latest)
+		})
+		if err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get stats from db")
+			return
+		}
+		if latest.Valid {
+			out.Latest = &latest.Time
+		}
+
+		if from != "" {
+			where += " AND timestamp >= ?"
+			args = append(args, fromTime)
+		} else if to != "" {
+			where += " AND timestamp >= ? - INTERVAL " + b.span
+			args = append(args, toTime)
+		} else {
+			where += " AND timestamp >= NOW() - INTERVAL " + b.span
+		}
+		if to != "" {
+			where += " AND timestamp < ?"
+			args = append(args, toTime)
+		}
+		err = withRetry(r.Context(), "message_stats", func() error {
+			out.Buckets = out.Buckets[:0]
+			rows, err := db.Query("SELECT DATE_FORMAT(timestamp, '"+b.format+"'), COUNT(*)"+where+" GROUP BY 1 ORDER BY 1", args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var sb statsBucket
+				if err := rows.Scan(&sb.Start, &sb.Count); err != nil {
+					return err
+				}
+				out.Buckets = append(out.Buckets, sb)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get stats from db")
+			return
+		}
+
+		var body bytes.Buffer
+		json.NewEncoder(&body).Encode(out)
+		if stats_cache_ttl > 0 {
+			cachedStats.put(r.Context(), cacheKey, body.Bytes())
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(body.Bytes())
+	})
+}
+
+// adminStats serves /admin/stats: how many messages there are, held for
+// review and archived, and how the backups are doing. stored and latest are
+// read from the blob store, last_run is the last backup of this replica.
+func adminStats() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(rw, r) {
+			return
+		}
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		var out struct {
+			Messages int `json:"messages"`
+			Flagged  int `json:"flagged"`
+			Archived int `json:"archived"`
+			Backups  struct {
+				Stored  int       `json:"stored"`
+				Latest  string    `json:"latest,omitempty"`
+				Error   string    `json:"error,omitempty"`
+				LastRun backupRun `json:"last_run"`
+			} `json:"backups"`
+		}
+		err = withRetry(r.Context(), "admin_stats", func() error {
+			return db.QueryRowContext(r.Context(), "SELECT COUNT(*), COALESCE(SUM(flagged), 0), (SELECT COUNT(*) FROM messages_archive) FROM messages").Scan(&out.Messages, &out.Flagged, &out.Archived)
+		})
+		if err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get stats from db")
+			return
+		}
+		// An unreachable blob store is reported rather than failing the
+		// counts.
+		keys, err := listBackups(r.Context())
+		if err != nil {
+			out.Backups.Error = err.Error()
+		} else if out.Backups.Stored = len(keys); len(keys) > 0 {
+			out.Backups.Latest = keys[len(keys)-1]
+		}
+		lastBackup.Lock()
+		out.Backups.LastRun = lastBackup.backupRun
+		lastBackup.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
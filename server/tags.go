@@ -0,0 +1,118 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const maxTagsPerMessage = 10
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+type tagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// normalizeTags lowercases, validates and de-duplicates the tags sent with a
+// message, keeping the order in which they were given.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxTagsPerMessage {
+		return nil, fmt.Errorf("A message can have at most %d tags!", maxTagsPerMessage)
+	}
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	return out, nil
+}
+
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("Tag %q is not valid! Tags are 1-32 characters of a-z, 0-9, '-' and '_'.", tag)
+	}
+	return tag, nil
+}
+
+// tagMessage attaches tags to an already inserted message. Tags are created on
+// first use; ON DUPLICATE KEY UPDATE with LAST_INSERT_ID(id) makes the insert
+// return the id of the existing row so no extra lookup is needed.
+func tagMessage(tx *sql.Tx, messageID int64, tags []string) error {
+	for _, tag := range tags {
+		res, err := tx.Exec("INSERT INTO tags(name) VALUES(?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)", tag)
+		if err != nil {
+			return err
+		}
+		tagID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO message_tags(message_id, tag_id) VALUES(?, ?)", messageID, tagID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitTags turns the GROUP_CONCAT column of a message listing back into a
+// slice. Tag names never contain commas, so the default separator is safe.
+func splitTags(concat sql.NullString) []string {
+	if !concat.Valid || concat.String == "" {
+		return nil
+	}
+	return strings.Split(concat.String, ",")
+}
+
+func listTags() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		var rows *sql.Rows
+		err = withRetry(r.Context(), "list_tags", func() (err error) {
+			rows, err = db.Query("SELECT t.name, COUNT(*) AS n FROM tags t JOIN message_tags mt ON mt.tag_id = t.id JOIN messages m ON m.id = mt.message_id AND m.flagged = 0 WHERE m.channel = ? GROUP BY t.id, t.name ORDER BY n DESC, t.name", channelOf(r).name)
+			return err
+		})
+		if err != nil {
+			http.Error(rw, "Unable to get tags from db", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []tagCount{}
+		for rows.Next() {
+			var temp tagCount
+			if err := rows.Scan(&temp.Name, &temp.Count); err != nil {
+				log.Println(err)
+				http.Error(rw, "Unable to get tags from db", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, temp)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println(err)
+			http.Error(rw, "Unable to get tags from db", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(rw).Encode(out)
+	})
+}
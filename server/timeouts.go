@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const timeoutMessage = "Timeout! Server is taking unexpected amount of time to respond."
+
+// downloadRoute is the key of attachment downloads in the timeout table.
+// They are served below /messages/ but stream, so they get their own entry.
+const downloadRoute = "/messages/{id}/attachments/{name}"
+
+// longPollRoute is the key of listings with ?wait=, which are held until
+// new messages arrive.
+const longPollRoute = "/messages?wait="
+
+// defaultRouteTimeouts are the timeouts of routes that differ from
+// -request_timeout. Zero means no timeout, for responses that stream.
+var defaultRouteTimeouts = map[string]time.Duration{
+	"/health":     time.Second,
+	"/readyz":     time.Second,
+	downloadRoute: 0,
+	longPollRoute: 0,
+	exportRoute:   0,
+}
+
+var routeTimeouts map[string]time.Duration
+
+// parseRouteTimeouts parses -route_timeouts, a comma separated list of
+// route=duration pairs layered over defaultRouteTimeouts.
+func parseRouteTimeouts(spec string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration, len(defaultRouteTimeouts))
+	for route, d := range defaultRouteTimeouts {
+		out[route] = d
+	}
+	for _, entry := range splitList(spec) {
+		i := strings.LastIndexByte(entry, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("route timeout %q needs a duration, use route=duration", entry)
+		}
+		d, err := time.ParseDuration(entry[i+1:])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("route timeout %q is not a valid duration", entry)
+		}
+		out[entry[:i]] = d
+	}
+	return out, nil
+}
+
+func routeTimeout(route string) time.Duration {
+	if d, ok := routeTimeouts[route]; ok {
+		return d
+	}
+	return request_timeout
+}
+
+// withTimeout limits how long the handler of a route may take. The response
+// is buffered until the handler returns, so streaming routes must not have a
+// timeout.
+func withTimeout(route string, h http.Handler) http.Handler {
+	d := routeTimeout(route)
+	if d <= 0 {
+		return h
+	}
+	return http.TimeoutHandler(h, d, timeoutMessage)
+}
+
+// handle registers a handler on mux with the timeout of its pattern.
+func handle(mux *http.ServeMux, pattern string, h http.Handler) {
+	mux.Handle(pattern, withTimeout(pattern, h))
+}
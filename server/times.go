@@ -0,0 +1,42 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Timestamps are stored and returned in UTC as RFC 3339. ?tz= returns them
+// in another zone instead, for display.
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// parseTime reads a time given in a query, RFC 3339 or a date with an
+// optional time, which is taken to be UTC.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.New("times must be like 2006-01-02T15:04:05Z, 2006-01-02 15:04:05 or 2006-01-02!")
+}
+
+// displayZone is the zone of ?tz=, an IANA name like Europe/Berlin, or UTC.
+func displayZone(r *http.Request) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.New("tz must be a time zone like Europe/Berlin!")
+	}
+	return loc, nil
+}
+
+func inZone(msgs []messageType, loc *time.Location) {
+	for i := range msgs {
+		msgs[i].Timestamp = msgs[i].Timestamp.In(loc)
+	}
+}
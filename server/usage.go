@@ -0,0 +1,442 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Usage is counted per access key, which is per channel, in the
+// usage_counts table by UTC day and month. Requests are counted when they
+// pass authorized, messages when they are stored. With Redis the counts are
+// kept there, in a hash per channel and period, and added to the table
+// every -usage_flush_interval.
+
+var quotaRejections = newCounter("usage_quota_rejections_total", "Requests refused with 429 because a quota was used up, by quota.", "quota")
+
+type quota struct {
+	name     string
+	limit    *int
+	monthly  bool
+	messages bool
+}
+
+var quotas = []quota{
+	{"requests_daily", &quota_requests_daily, false, false},
+	{"requests_monthly", &quota_requests_monthly, true, false},
+	{"messages_daily", &quota_messages_daily, false, true},
+	{"messages_monthly", &quota_messages_monthly, true, true},
+}
+
+func quotasSet() bool {
+	for _, q := range quotas {
+		if *q.limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func usagePeriods(now time.Time) (day, month string) {
+	now = now.UTC()
+	return now.Format("2006-01-02"), now.Format("2006-01")
+}
+
+// periodEnd is when the day or month of now ends and its quotas reset.
+func periodEnd(now time.Time, monthly bool) time.Time {
+	y, m, d := now.UTC().Date()
+	if monthly {
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+type usageCounts struct {
+	requests, messages int
+}
+
+// loadUsage returns the counts of channel for the current day and month.
+func loadUsage(ctx context.Context, db *sql.DB, channel string, day, month string) (map[string]usageCounts, error) {
+	if rdb != nil {
+		out, err := redisLoadUsage(ctx, db, channel, day, month)
+		if err == nil {
+			return out, nil
+		}
+		log.Println(err)
+	}
+	return loadStoredUsage(ctx, db, channel, day, month)
+}
+
+func loadStoredUsage(ctx context.Context, db *sql.DB, channel string, day, month string) (map[string]usageCounts, error) {
+	out := map[string]usageCounts{}
+	err := withRetry(ctx, "load_usage", func() error {
+		rows, err := db.Query("SELECT period, requests, messages FROM usage_counts WHERE channel = ? AND period IN (?, ?)", channel, day, month)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var period string
+			var c usageCounts
+			if err := rows.Scan(&period, &c.requests, &c.messages); err != nil {
+				return err
+			}
+			out[period] = c
+		}
+		return rows.Err()
+	})
+	return out, err
+}
+
+func countUsage(ctx context.Context, db *sql.DB, column, channel, day, month string) error {
+	if rdb != nil {
+		err := redisCountUsage(ctx, column, channel, day, month)
+		if err == nil {
+			return nil
+		}
+		log.Println(err)
+	}
+	return withRetry(ctx, "count_usage", func() error {
+		_, err := db.Exec("INSERT INTO usage_counts(channel, period, "+column+") VALUES (?, ?, 1), (?, ?, 1) ON DUPLICATE KEY UPDATE "+column+" = "+column+" + 1", channel, day, channel, month)
+		return err
+	})
+}
+
+// usageKeys are the Redis hashes counting a channel's usage in the day and
+// month of now, with the time they expire, a day after their period.
+func usageKeys(channel, day, month string) (keys [2]string, expires [2]string) {
+	now := time.Now()
+	for i, period := range []string{day, month} {
+		keys[i] = rdb.key("usage", channel, period)
+		expires[i] = strconv.FormatInt(periodEnd(now, i == 1).Add(24*time.Hour).Unix(), 10)
+	}
+	return keys, expires
+}
+
+// usageTouched are the channels and periods counted in Redis by this
+// replica since the last flush.
+var usageTouched = struct {
+	sync.Mutex
+	keys map[[2]string]bool
+}{keys: map[[2]string]bool{}}
+
+// redisCountUsage counts into the field column of the hashes, and into
+// pending_column what is yet to be added to usage_counts.
+func redisCountUsage(ctx context.Context, column, channel, day, month string) error {
+	keys, expires := usageKeys(channel, day, month)
+	var cmds [][]string
+	for i, key := range keys {
+		cmds = append(cmds,
+			[]string{"HINCRBY", key, column, "1"},
+			[]string{"HINCRBY", key, "pending_" + column, "1"},
+			[]string{"EXPIREAT", key, expires[i]})
+	}
+	if _, err := rdb.tx(ctx, cmds...); err != nil {
+		return err
+	}
+	usageTouched.Lock()
+	usageTouched.keys[[2]string{channel, day}] = true
+	usageTouched.keys[[2]string{channel, month}] = true
+	usageTouched.Unlock()
+	return nil
+}
+
+// redisLoadUsage reads the counts of the hashes. A hash is seeded with the
+// counts in usage_counts when it is first read, so enabling Redis in the
+// middle of a period does not start its quotas over.
+func redisLoadUsage(ctx context.Context, db *sql.DB, channel, day, month string) (map[string]usageCounts, error) {
+	keys, expires := usageKeys(channel, day, month)
+	replies, err := rdb.pipeline(ctx,
+		[]string{"HMGET", keys[0], "requests", "messages", "seeded"},
+		[]string{"HMGET", keys[1], "requests", "messages", "seeded"})
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]usageCounts{}
+	var stored map[string]usageCounts
+	for i, period := range []string{day, month} {
+		fields, _ := replies[i].([]interface{})
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("redis: unexpected reply to HMGET %s", keys[i])
+		}
+		counts := usageCounts{requests: replyInt(fields[0]), messages: replyInt(fields[1])}
+		if fields[2] == nil {
+			if stored == nil {
+				if stored, err = loadStoredUsage(ctx, db, channel, day, month); err != nil {
+					return nil, err
+				}
+			}
+			seed := stored[period]
+			if err := seedUsage(ctx, keys[i], expires[i], seed); err != nil {
+				return nil, err
+			}
+			counts.requests += seed.requests
+			counts.messages += seed.messages
+		}
+		out[period] = counts
+	}
+	return out, nil
+}
+
+// seedUsage adds the stored counts to a hash unless another replica already
+// did.
+func seedUsage(ctx context.Context, key, expires string, seed usageCounts) error {
+	won, err := rdb.do(ctx, "HSETNX", key, "seeded", "1")
+	if err != nil || replyInt(won) == 0 {
+		return err
+	}
+	_, err = rdb.tx(ctx,
+		[]string{"HINCRBY", key, "requests", strconv.Itoa(seed.requests)},
+		[]string{"HINCRBY", key, "messages", strconv.Itoa(seed.messages)},
+		[]string{"EXPIREAT", key, expires})
+	return err
+}
+
+// flushUsage adds the pending counts of the hashes this replica counted
+// into to usage_counts. Hashes not seeded yet are left for the next flush,
+// their seed will be read from the table.
+func flushUsage(ctx context.Context) error {
+	usageTouched.Lock()
+	touched := usageTouched.keys
+	usageTouched.keys = map[[2]string]bool{}
+	usageTouched.Unlock()
+	retry := func(channel, period string) {
+		usageTouched.Lock()
+		usageTouched.keys[[2]string{channel, period}] = true
+		usageTouched.Unlock()
+	}
+	db, err := initDB()
+	if err != nil {
+		for k := range touched {
+			retry(k[0], k[1])
+		}
+		return err
+	}
+	var firstErr error
+	for k := range touched {
+		channel, period := k[0], k[1]
+		key := rdb.key("usage", channel, period)
+		seeded, err := rdb.do(ctx, "HEXISTS", key, "seeded")
+		if err == nil && replyInt(seeded) == 0 {
+			retry(channel, period)
+			continue
+		}
+		var replies []interface{}
+		if err == nil {
+			replies, err = rdb.tx(ctx,
+				[]string{"HGET", key, "pending_requests"},
+				[]string{"HGET", key, "pending_messages"},
+				[]string{"HDEL", key, "pending_requests", "pending_messages"})
+		}
+		if err != nil {
+			retry(channel, period)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		requests, messages := replyInt(replies[0]), replyInt(replies[1])
+		if requests == 0 && messages == 0 {
+			continue
+		}
+		err = withRetry(ctx, "flush_usage", func() error {
+			_, err := db.Exec("INSERT INTO usage_counts(channel, period, requests, messages) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE requests = requests + VALUES(requests), messages = messages + VALUES(messages)", channel, period, requests, messages)
+			return err
+		})
+		if err != nil {
+			// The counts go back to be flushed again.
+			if _, rerr := rdb.tx(ctx,
+				[]string{"HINCRBY", key, "pending_requests", strconv.Itoa(requests)},
+				[]string{"HINCRBY", key, "pending_messages", strconv.Itoa(messages)}); rerr != nil {
+				log.Println("Lost usage counts of", channel, period, "in Redis:", rerr)
+			}
+			retry(channel, period)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// usageFlusher flushes the usage counted in Redis every
+// -usage_flush_interval, and once more when the server shuts down.
+func usageFlusher(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(usage_flush_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := flushUsage(ctx); err != nil {
+				logger.Println("Could not flush usage counts:", err)
+			}
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := flushUsage(final); err != nil {
+				logger.Println("Could not flush usage counts:", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// trimUsage deletes the counts of the days and months that ended more than
+// -usage_retention ago and returns how many.
+func trimUsage(ctx context.Context) (int, error) {
+	db, err := initDB()
+	if err != nil {
+		return 0, err
+	}
+	day, month := usagePeriods(time.Now().Add(-usage_retention))
+	var n int64
+	err = withRetry(ctx, "trim_usage", func() error {
+		res, err := db.ExecContext(ctx, "DELETE FROM usage_counts WHERE (LENGTH(period) = 10 AND period < ?) OR (LENGTH(period) = 7 AND period < ?)", day, month)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// checkQuotas answers with 429 and returns false when one of the request or
+// message quotas is used up, and sends the X-RateLimit headers of the one
+// closest to it. Metering fails open, an unreachable table does not refuse
+// requests the database may still serve. Requests are counted whether or
+// not a quota is set, without one nothing is looked up.
+func checkQuotas(rw http.ResponseWriter, r *http.Request, messages bool) bool {
+	db, err := initDB()
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	now := time.Now()
+	day, month := usagePeriods(now)
+	channel := channelOf(r).name
+	if !messages {
+		if err := countUsage(r.Context(), db, "requests", channel, day, month); err != nil {
+			log.Println(err)
+			return true
+		}
+	}
+	if !quotasSet() {
+		return true
+	}
+	usage, err := loadUsage(r.Context(), db, channel, day, month)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	var tightest, exceeded *quota
+	var remaining int
+	for i := range quotas {
+		q := &quotas[i]
+		if *q.limit <= 0 || q.messages != messages {
+			continue
+		}
+		counts := usage[day]
+		if q.monthly {
+			counts = usage[month]
+		}
+		// The request being served, or the message about to be stored,
+		// is part of the usage.
+		used := counts.requests
+		if q.messages {
+			used = counts.messages + 1
+		}
+		if used > *q.limit && exceeded == nil {
+			exceeded = q
+		}
+		if left := *q.limit - used; tightest == nil || left < remaining {
+			tightest, remaining = q, left
+		}
+	}
+	if tightest == nil {
+		return true
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(*tightest.limit))
+	rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	rw.Header().Set("X-RateLimit-Reset", strconv.FormatInt(periodEnd(now, tightest.monthly).Unix(), 10))
+	if exceeded != nil {
+		quotaRejections.inc(exceeded.name)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(time.Until(periodEnd(now, exceeded.monthly)).Seconds())+1))
+		http.Error(rw, fmt.Sprintf("Quota %s of %d is used up!", exceeded.name, *exceeded.limit), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// countMessage counts a stored message against the key of its channel.
+func countMessage(ctx context.Context, db *sql.DB, channel string) {
+	day, month := usagePeriods(time.Now())
+	if err := countUsage(ctx, db, "messages", channel, day, month); err != nil {
+		log.Println(err)
+	}
+}
+
+type usageReport struct {
+	Channel  string `json:"channel"`
+	Period   string `json:"period"`
+	Requests int    `json:"requests"`
+	Messages int    `json:"messages"`
+}
+
+// listUsage serves /admin/usage, the counts of every key by day and month.
+// ?channel= and ?period= (like 2006-01-02 or 2006-01) narrow it down.
+func listUsage() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(rw, r) {
+			return
+		}
+		db, err := readDB()
+		if err != nil {
+			storeError(rw, err, "Unable to connect to db")
+			return
+		}
+		query := "SELECT channel, period, requests, messages FROM usage_counts WHERE 1 = 1"
+		var args []interface{}
+		if channel := r.URL.Query().Get("channel"); channel != "" {
+			query += " AND channel = ?"
+			args = append(args, channel)
+		}
+		if period := r.URL.Query().Get("period"); period != "" {
+			query += " AND period = ?"
+			args = append(args, period)
+		}
+		out := []usageReport{}
+		err = withRetry(r.Context(), "list_usage", func() error {
+			out = out[:0]
+			rows, err := db.Query(query+" ORDER BY channel, period", args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var u usageReport
+				if err := rows.Scan(&u.Channel, &u.Period, &u.Requests, &u.Messages); err != nil {
+					return err
+				}
+				out = append(out, u)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			log.Println(err)
+			storeError(rw, err, "Unable to get usage from db")
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(out)
+	})
+}
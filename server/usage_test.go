@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckQuotasCountsWithoutQuotas(t *testing.T) {
+	db := setupStore(t)
+	for i := 0; i < 3; i++ {
+		if !checkQuotas(httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil), false) {
+			t.Fatal("request refused without quotas")
+		}
+	}
+	day, month := usagePeriods(time.Now())
+	for _, period := range []string{day, month} {
+		var requests int
+		if err := db.QueryRow("SELECT requests FROM usage_counts WHERE channel = ? AND period = ?", defaultChannel, period).Scan(&requests); err != nil || requests != 3 {
+			t.Errorf("%s: %d requests counted, want 3 (%v)", period, requests, err)
+		}
+	}
+}